@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"log"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -10,14 +12,28 @@ import (
 	"github.com/pkg/errors"
 )
 
+// maxCacheAge is how long entries are considered fresh. Older entries are
+// still served, but refreshed in background.
 const maxCacheAge = time.Hour
 
+// maxStaleAge is how long outdated entries are kept in memory.
+const maxStaleAge = 7 * 24 * time.Hour
+
+// maxCachedDays limits amount of days kept in memory for each group.
+const maxCachedDays = 100
+
+// maxStoredAge is how long timetable and overrides of past days are kept.
+const maxStoredAge = 90 * 24 * time.Hour
+
 type LessonType int
 
 const (
 	Lab      LessonType = 0
-	Practice            = 1
-	Lecture             = 2
+	Practice LessonType = 1
+	Lecture  LessonType = 2
+	Credit   LessonType = 3
+	Exam     LessonType = 4
+	Seminar  LessonType = 5
 )
 
 type Entry struct {
@@ -33,33 +49,86 @@ type cachedEntries struct {
 	retrievedOn time.Time
 }
 
+// dayKey identifies timetable of one group for one day.
+type dayKey struct {
+	group string
+	day   time.Time
+}
+
+// DayChange describes change of downloaded timetable for day.
+type DayChange struct {
+	Day      time.Time
+	Old, New []Entry
+}
+
 type Cache struct {
+	// OnChange, if set, is called when refreshed timetable of group for
+	// today or following days differs from previously downloaded one.
+	OnChange func(group string, changes []DayChange)
+
+	// sources contains timetable source for each group.
+	sources map[string]ttparser.Source
+	// store is optional persistent storage for downloaded entries, can be nil.
+	store *Storage
+
 	cacheLck sync.RWMutex
-	cache    map[time.Time]cachedEntries
+	cache    map[dayKey]cachedEntries
+	// refreshing contains weeks (keyed by first day) being refreshed in background.
+	refreshing map[dayKey]bool
 
-	cleanUpTicker *time.Ticker
-	tickerStop    chan bool
+	// inflight contains downloads in progress keyed by first day of week.
+	inflightLck sync.Mutex
+	inflight    map[dayKey]*weekDownload
+
+	statsLck sync.Mutex
+	stats    CacheStats
+
+	overridesLck sync.RWMutex
+	overrides    map[dayKey][]Override
+
+	// stopJanitor stops cleanUpTick, janitorDone is closed when it exits.
+	stopJanitor context.CancelFunc
+	janitorDone chan struct{}
 }
 
-func NewCache() *Cache {
+func NewCache(sources map[string]ttparser.Source, store *Storage) (*Cache, error) {
 	c := new(Cache)
 
-	c.cache = make(map[time.Time]cachedEntries)
-	c.cleanUpTicker = time.NewTicker(15 * time.Minute)
-	c.tickerStop = make(chan bool)
-	go c.cleanUpTick()
-	return c
+	c.sources = sources
+	c.store = store
+	c.cache = make(map[dayKey]cachedEntries)
+	c.refreshing = make(map[dayKey]bool)
+	c.inflight = make(map[dayKey]*weekDownload)
+	c.overrides = make(map[dayKey][]Override)
+	if store != nil {
+		overrides, err := store.LoadOverrides(timezone)
+		if err != nil {
+			return nil, errors.Wrap(err, "load overrides")
+		}
+		for _, o := range overrides {
+			// Overrides created before multi-group support have no group.
+			if o.Group == "" {
+				o.Group = config().DefaultGroup
+			}
+			key := dayKey{o.Group, o.Day}
+			c.overrides[key] = append(c.overrides[key], o)
+		}
+	}
+	var ctx context.Context
+	ctx, c.stopJanitor = context.WithCancel(context.Background())
+	c.janitorDone = make(chan struct{})
+	go c.cleanUpTick(ctx)
+	return c, nil
 }
 
 func (c *Cache) Close() error {
-	c.tickerStop <- true
-	<-c.tickerStop
-	c.cleanUpTicker.Stop()
+	c.stopJanitor()
+	<-c.janitorDone
 	return nil
 }
 
-func (c *Cache) ExactGet(t time.Time) (*Entry, error) {
-	day, err := c.OnDay(StripTime(t, t.Location()))
+func (c *Cache) ExactGet(group string, t time.Time) (*Entry, error) {
+	day, err := c.OnDay(group, StripTime(t, t.Location()))
 	if err != nil {
 		return nil, err
 	}
@@ -72,78 +141,394 @@ func (c *Cache) ExactGet(t time.Time) (*Entry, error) {
 	return nil, nil
 }
 
-func (c *Cache) cleanUpTick() {
+// SlotEntries returns all entries starting at t, there can be several
+// parallel lessons, e.g. of subgroups.
+func (c *Cache) SlotEntries(group string, t time.Time) ([]Entry, error) {
+	day, err := c.OnDay(group, StripTime(t, t.Location()))
+	if err != nil {
+		return nil, err
+	}
+
+	res := []Entry{}
+	for _, ent := range day {
+		if ent.Time.Truncate(time.Minute) == t.Truncate(time.Minute) {
+			res = append(res, ent)
+		}
+	}
+	return res, nil
+}
+
+func (c *Cache) cleanUpTick(ctx context.Context) {
+	defer close(c.janitorDone)
+
+	ticker := time.NewTicker(15 * time.Minute)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-c.cleanUpTicker.C:
+		case <-ticker.C:
 			c.cleanUp()
-		case <-c.tickerStop:
-			c.tickerStop <- true
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (c *Cache) OnDay(day time.Time) ([]Entry, error) {
-	day = StripTime(day, day.Location())
+// OnDay returns entries for specified group and day with overrides applied.
+func (c *Cache) OnDay(group string, day time.Time) ([]Entry, error) {
+	entries, _, err := c.OnDayWithAge(group, day)
+	return entries, err
+}
 
+// OnDayWithAge is like OnDay, but also returns time when entries were
+// downloaded. Outdated entries are returned if they can't be refreshed
+// right now, see IsOutdated.
+func (c *Cache) OnDayWithAge(group string, day time.Time) ([]Entry, time.Time, error) {
+	key := dayKey{group, StripTime(day, day.Location())}
+	entries, err := c.downloadedOnDay(key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	c.overridesLck.RLock()
+	defer c.overridesLck.RUnlock()
+	return applyOverrides(key.day, entries.entries, c.overrides[key]), entries.retrievedOn, nil
+}
+
+// CachedOnDay is like OnDayWithAge, but never downloads anything. false is
+// returned if day is neither cached nor stored.
+func (c *Cache) CachedOnDay(group string, day time.Time) ([]Entry, time.Time, bool) {
+	key := dayKey{group, StripTime(day, day.Location())}
 	c.cacheLck.RLock()
-	entries, prs := c.cache[day]
+	entries, prs := c.cache[key]
 	c.cacheLck.RUnlock()
 
-	if !prs || entries.retrievedOn.Add(maxCacheAge).Before(time.Now()) {
-		if err := c.downloadWeek(day); err != nil {
-			return nil, err
+	if !prs && c.store != nil {
+		entries, prs = c.loadStored(key)
+	}
+	if !prs {
+		return nil, time.Time{}, false
+	}
+
+	c.overridesLck.RLock()
+	defer c.overridesLck.RUnlock()
+	return applyOverrides(key.day, entries.entries, c.overrides[key]), entries.retrievedOn, true
+}
+
+// IsOutdated checks whether entries downloaded at retrievedOn should be refreshed.
+func IsOutdated(retrievedOn time.Time) bool {
+	return retrievedOn.Add(maxCacheAge).Before(time.Now())
+}
+
+// AddOverride stores override and applies it to all following queries.
+func (c *Cache) AddOverride(o Override) error {
+	o.Day = StripTime(o.Day, o.Day.Location())
+	key := dayKey{o.Group, o.Day}
+	if c.store != nil {
+		id, err := c.store.SaveOverride(o)
+		if err != nil {
+			return errors.Wrap(err, "save override")
 		}
-		return c.cache[day].entries, nil
+		o.ID = id
 	}
 
-	return entries.entries, nil
+	c.overridesLck.Lock()
+	defer c.overridesLck.Unlock()
+	c.overrides[key] = append(c.overrides[key], o)
+	return nil
 }
 
-func (c *Cache) downloadWeek(day time.Time) error {
-	fromDay := day
-	toDay := day
-	for fromDay.Weekday() != time.Monday {
-		fromDay = fromDay.Add(-24 * time.Hour)
+// ResetOverrides removes all overrides for specified group's timeslot.
+func (c *Cache) ResetOverrides(group string, day time.Time, num int) error {
+	key := dayKey{group, StripTime(day, day.Location())}
+	if c.store != nil {
+		if err := c.store.DeleteOverrides(group, key.day, num); err != nil {
+			return errors.Wrap(err, "delete overrides")
+		}
+	}
+
+	c.overridesLck.Lock()
+	defer c.overridesLck.Unlock()
+	kept := []Override(nil)
+	for _, o := range c.overrides[key] {
+		if o.Num != num {
+			kept = append(kept, o)
+		}
 	}
-	for toDay.Weekday() != time.Sunday {
-		toDay = toDay.Add(24 * time.Hour)
+	if len(kept) == 0 {
+		delete(c.overrides, key)
+	} else {
+		c.overrides[key] = kept
 	}
+	return nil
+}
 
-	log.Printf("Downloading table for %s-%s...\n", fromDay.Format("02.01.2006"), toDay.Format("02.01.2006"))
-	rawTable, err := ttparser.Download(fromDay, toDay, config.SourceCfg)
-	if err != nil {
-		return errors.Wrap(err, "table download")
+// Refresh downloads week containing day for group, even if it is cached.
+func (c *Cache) Refresh(group string, day time.Time) error {
+	return c.downloadWeek(group, StripTime(day, day.Location()))
+}
+
+// downloadedOnDay returns entries for day as downloaded from source.
+// If there are only outdated entries, they are returned and refreshed in
+// background. Error is returned only if there is no data at all.
+func (c *Cache) downloadedOnDay(key dayKey) (cachedEntries, error) {
+	c.cacheLck.RLock()
+	entries, prs := c.cache[key]
+	c.cacheLck.RUnlock()
+
+	if !prs && c.store != nil {
+		entries, prs = c.loadStored(key)
 	}
 
+	if !prs {
+		if err := c.downloadWeek(key.group, key.day); err != nil {
+			return cachedEntries{}, err
+		}
+		c.cacheLck.RLock()
+		defer c.cacheLck.RUnlock()
+		return c.cache[key], nil
+	}
+
+	if IsOutdated(entries.retrievedOn) {
+		c.refreshInBackground(key)
+	}
+	return entries, nil
+}
+
+// refreshInBackground starts download of week containing key's day, unless
+// it is already in progress.
+func (c *Cache) refreshInBackground(key dayKey) {
+	from, _ := weekBounds(key.day)
+	weekKey := dayKey{key.group, from}
+
 	c.cacheLck.Lock()
 	defer c.cacheLck.Unlock()
+	if c.refreshing[weekKey] {
+		return
+	}
+	c.refreshing[weekKey] = true
+
+	// Tracked, so shutdown waits for it before closing storage.
+	go tracked("refreshing timetable of "+key.group, func() {
+		defer func() {
+			c.cacheLck.Lock()
+			delete(c.refreshing, weekKey)
+			c.cacheLck.Unlock()
+		}()
+
+		if err := c.downloadWeek(key.group, key.day); err != nil {
+			log.Printf("ERROR: Failed to refresh table for %s on %s, serving outdated data: %v\n",
+				key.group, key.day.Format("02.01.2006"), err)
+		}
+	})()
+}
+
+// weekBounds returns first (Monday) and last (Sunday) days of week containing day.
+func weekBounds(day time.Time) (from, to time.Time) {
+	from = day
+	to = day
+	for from.Weekday() != time.Monday {
+		from = from.AddDate(0, 0, -1)
+	}
+	for to.Weekday() != time.Sunday {
+		to = to.AddDate(0, 0, 1)
+	}
+	return from, to
+}
+
+// loadStored puts entries for day from persistent storage into in-memory cache.
+func (c *Cache) loadStored(key dayKey) (cachedEntries, bool) {
+	entries, retrievedOn, err := c.store.LoadDay(key.group, key.day)
+	if err != nil {
+		log.Printf("ERROR: Failed to load stored entries for %s on %s: %v\n", key.group, key.day.Format("02.01.2006"), err)
+		return cachedEntries{}, false
+	}
+	if retrievedOn.IsZero() {
+		return cachedEntries{}, false
+	}
+
+	res := cachedEntries{entries, retrievedOn}
+	c.cacheLck.Lock()
+	c.cache[key] = res
+	c.cacheLck.Unlock()
+	return res, true
+}
+
+// weekDownload is download of week shared by all concurrent callers.
+type weekDownload struct {
+	done chan struct{}
+	err  error
+}
+
+// CacheStats contains counters of week downloads.
+type CacheStats struct {
+	// Downloads is amount of requests made to sources.
+	Downloads uint64
+	// Failed is amount of failed requests.
+	Failed uint64
+	// Coalesced is amount of downloadWeek calls that waited for download
+	// already in progress instead of starting new one.
+	Coalesced uint64
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.statsLck.Lock()
+	defer c.statsLck.Unlock()
+	return c.stats
+}
+
+// downloadWeek downloads week containing day. Concurrent calls for the
+// same week share single download.
+func (c *Cache) downloadWeek(group string, day time.Time) (err error) {
+	from, _ := weekBounds(day)
+	key := dayKey{group, from}
+
+	c.inflightLck.Lock()
+	if dl, prs := c.inflight[key]; prs {
+		c.inflightLck.Unlock()
+		c.statsLck.Lock()
+		c.stats.Coalesced++
+		c.statsLck.Unlock()
+
+		<-dl.done
+		return dl.err
+	}
+	dl := &weekDownload{done: make(chan struct{})}
+	c.inflight[key] = dl
+	c.inflightLck.Unlock()
+
+	// Waiters must be released even if fetch panics, otherwise they would
+	// block forever and week could never be downloaded again.
+	defer func() {
+		if r := recover(); r != nil {
+			reportPanic("downloading timetable of "+group, r)
+			dl.err = errors.Errorf("panic: %v", r)
+			err = dl.err
+		}
+
+		c.statsLck.Lock()
+		c.stats.Downloads++
+		if dl.err != nil {
+			c.stats.Failed++
+		}
+		c.statsLck.Unlock()
+
+		c.inflightLck.Lock()
+		delete(c.inflight, key)
+		c.inflightLck.Unlock()
+		close(dl.done)
+	}()
+
+	dl.err = c.fetchWeek(group, day)
+	return dl.err
+}
+
+// fetchWeek downloads week containing day and updates cache with results.
+func (c *Cache) fetchWeek(group string, day time.Time) error {
+	source, prs := c.sources[group]
+	if !prs {
+		return errors.Errorf("unknown group: %s", group)
+	}
+
+	fromDay, toDay := weekBounds(day)
+
+	log.Printf("Downloading table for %s, %s-%s...\n", group, fromDay.Format("02.01.2006"), toDay.Format("02.01.2006"))
+	rawTable, err := source.Fetch(fromDay, toDay)
+	if err != nil {
+		return errors.Wrap(err, "table download")
+	}
+
+	week := make(map[dayKey]cachedEntries)
 	for fromDay.Before(toDay.Add(24 * time.Hour)) {
-		c.cache[fromDay] = cachedEntries{
+		week[dayKey{group, fromDay}] = cachedEntries{
 			entries:     FromRaw(fromDay, rawTable[StripTime(fromDay, time.UTC)]),
 			retrievedOn: time.Now(),
 		}
 		fromDay = fromDay.Add(24 * time.Hour)
 	}
+
+	changes := c.detectChanges(week)
+
+	c.cacheLck.Lock()
+	for key, entries := range week {
+		c.cache[key] = entries
+	}
+	c.cacheLck.Unlock()
+
+	if c.store != nil {
+		for key, entries := range week {
+			if err := c.store.SaveDay(key.group, key.day, entries.entries, entries.retrievedOn); err != nil {
+				log.Printf("ERROR: Failed to save entries for %s on %s: %v\n", key.group, key.day.Format("02.01.2006"), err)
+			}
+		}
+	}
+
+	if len(changes) != 0 && c.OnChange != nil {
+		// Don't make user who triggered download wait for notifications.
+		if jobs.start() {
+			go func() {
+				defer jobs.done()
+				defer recoverJob("sending change notifications for " + group)
+				c.OnChange(group, changes)
+			}()
+		} else {
+			// Shutdown has begun and new jobs are not started. Caller is
+			// waited for, so notifications are not lost this way.
+			c.OnChange(group, changes)
+		}
+	}
 	return nil
 }
 
+// detectChanges compares freshly downloaded entries with previous version
+// (if there is any). Days before today are ignored.
+func (c *Cache) detectChanges(week map[dayKey]cachedEntries) []DayChange {
+	res := []DayChange{}
+	today := StripTime(time.Now().In(timezone), timezone)
+	for key, fresh := range week {
+		if key.day.Before(today) {
+			continue
+		}
+
+		c.cacheLck.RLock()
+		prev, prs := c.cache[key]
+		c.cacheLck.RUnlock()
+		if !prs && c.store != nil {
+			entries, retrievedOn, err := c.store.LoadDay(key.group, key.day)
+			if err != nil {
+				log.Printf("ERROR: Failed to load stored entries for %s on %s: %v\n", key.group, key.day.Format("02.01.2006"), err)
+				continue
+			}
+			prev, prs = cachedEntries{entries, retrievedOn}, !retrievedOn.IsZero()
+		}
+		if !prs {
+			continue
+		}
+
+		if !entriesEqual(prev.entries, fresh.entries) {
+			res = append(res, DayChange{key.day, prev.entries, fresh.entries})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Day.Before(res[j].Day)
+	})
+	return res
+}
+
 func (c *Cache) cleanUp() {
 	c.cacheLck.Lock()
 	defer c.cacheLck.Unlock()
 
 	totalRemoved := 0
 	for k, ent := range c.cache {
-		if ent.retrievedOn.Add(maxCacheAge).Before(time.Now()) {
+		if ent.retrievedOn.Add(maxStaleAge).Before(time.Now()) {
 			totalRemoved += 1
 			delete(c.cache, k)
 		}
 	}
 
-	for len(c.cache) > 100 {
+	for len(c.cache) > maxCachedDays*len(c.sources) {
 		oldestStamp := time.Now()
-		oldestDay := time.Time{}
+		oldestDay := dayKey{}
 		for k, ent := range c.cache {
 			if ent.retrievedOn.Before(oldestStamp) {
 				oldestStamp = ent.retrievedOn
@@ -158,24 +543,66 @@ func (c *Cache) cleanUp() {
 	}
 }
 
-func (c *Cache) Evict(date time.Time) {
+func (c *Cache) Evict(group string, date time.Time) {
 	day := StripTime(date, date.Location())
 	c.cacheLck.Lock()
-	defer c.cacheLck.Unlock()
+	delete(c.cache, dayKey{group, day})
+	c.cacheLck.Unlock()
 
-	delete(c.cache, day)
+	if c.store != nil {
+		if err := c.store.DeleteDay(group, day); err != nil {
+			log.Printf("ERROR: Failed to remove stored entries for %s on %s: %v\n", group, day.Format("02.01.2006"), err)
+		}
+	}
+}
+
+// PruneStored removes stored timetable and overrides for days before
+// specified one.
+func (c *Cache) PruneStored(before time.Time) error {
+	if c.store != nil {
+		if err := c.store.PruneDays(before); err != nil {
+			return errors.Wrap(err, "prune days")
+		}
+		if err := c.store.PruneOverrides(before); err != nil {
+			return errors.Wrap(err, "prune overrides")
+		}
+	}
+
+	c.overridesLck.Lock()
+	defer c.overridesLck.Unlock()
+	for key := range c.overrides {
+		if key.day.Before(before) {
+			delete(c.overrides, key)
+		}
+	}
+	return nil
+}
+
+// pruneStored removes timetable and overrides for days older than
+// maxStoredAge.
+func pruneStored() {
+	before := StripTime(time.Now().In(timezone).Add(-maxStoredAge), timezone)
+	if err := cache.PruneStored(before); err != nil {
+		log.Printf("ERROR: Failed to prune stored timetable: %v\n", err)
+	}
 }
 
 func FromRaw(date time.Time, e []ttparser.RawEntry) []Entry {
-	res := make([]Entry, len(e))
-	for i, ent := range e {
-		res[i] = Entry{
-			TimeSlotSet(date, config.TimeslotsBegin[ent.Sequence-1]),
-			lang.LessonTypeStrs[strings.ToLower(ent.Type)],
+	conf := config()
+	res := make([]Entry, 0, len(e))
+	for _, ent := range e {
+		if ent.Sequence < 1 || ent.Sequence > len(conf.TimeslotsBegin) {
+			log.Printf("ERROR: Skipping entry with unknown lesson number %d on %s: %+v\n",
+				ent.Sequence, date.Format("02.01.2006"), ent)
+			continue
+		}
+		res = append(res, Entry{
+			TimeSlotSet(date, conf.TimeslotsBegin[ent.Sequence-1]),
+			lang().LessonTypeStrs[strings.ToLower(ent.Type)],
 			ent.Classroom,
 			ent.Lecturer,
 			ent.Name,
-		}
+		})
 	}
 	log.Printf("Parsed entries: %+v", res)
 	return res
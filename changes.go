@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/slongfield/pyfmt"
+)
+
+// entryLess orders entries by all fields, so sorted lists of same entries
+// are equal regardless of order they came in.
+func entryLess(a, b Entry) bool {
+	switch {
+	case !a.Time.Equal(b.Time):
+		return a.Time.Before(b.Time)
+	case a.Type != b.Type:
+		return a.Type < b.Type
+	case a.Classroom != b.Classroom:
+		return a.Classroom < b.Classroom
+	case a.Lecturer != b.Lecturer:
+		return a.Lecturer < b.Lecturer
+	default:
+		return a.Name < b.Name
+	}
+}
+
+func entryEqual(a, b Entry) bool {
+	return a.Time.Equal(b.Time) &&
+		a.Type == b.Type &&
+		a.Classroom == b.Classroom &&
+		a.Lecturer == b.Lecturer &&
+		a.Name == b.Name
+}
+
+func sortedEntries(entries []Entry) []Entry {
+	res := append([]Entry(nil), entries...)
+	sort.Slice(res, func(i, j int) bool {
+		return entryLess(res[i], res[j])
+	})
+	return res
+}
+
+// entriesEqual checks whether a and b contain same entries, in any order.
+func entriesEqual(a, b []Entry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = sortedEntries(a), sortedEntries(b)
+	for i := range a {
+		if !entryEqual(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// subtractEntries returns entries of a that are not in b, counting
+// duplicates. Both lists should be sorted using entryLess.
+func subtractEntries(a, b []Entry) []Entry {
+	res := []Entry{}
+	j := 0
+	for _, ent := range a {
+		for j < len(b) && entryLess(b[j], ent) {
+			j++
+		}
+		if j < len(b) && entryEqual(b[j], ent) {
+			j++
+			continue
+		}
+		res = append(res, ent)
+	}
+	return res
+}
+
+func weekdayName(t time.Time) string {
+	if len(lang().Weekdays) != 7 {
+		return t.Weekday().String()
+	}
+	return lang().Weekdays[t.Weekday()]
+}
+
+// entriesByNum groups entries by lesson number. There can be several
+// entries with same number, e.g. for subgroups.
+func entriesByNum(entries []Entry) map[int][]Entry {
+	res := make(map[int][]Entry, len(entries))
+	for _, ent := range sortedEntries(entries) {
+		num := ttindex(TimeSlot{ent.Time.Hour(), ent.Time.Minute()})
+		res[num] = append(res[num], ent)
+	}
+	return res
+}
+
+// diffEntries returns human-readable description of changes in day's timetable.
+func diffEntries(change DayChange) []string {
+	oldByNum := entriesByNum(change.Old)
+	newByNum := entriesByNum(change.New)
+	day := weekdayName(change.Day) + " " + change.Day.Format("02.01")
+
+	res := []string{}
+	for num := 1; num <= len(config().TimeslotsBegin); num++ {
+		// Entries present in both versions didn't change.
+		removed := subtractEntries(oldByNum[num], newByNum[num])
+		added := subtractEntries(newByNum[num], oldByNum[num])
+		args := func(ent Entry) map[string]interface{} {
+			return map[string]interface{}{
+				"day":       day,
+				"num":       num,
+				"name":      ent.Name,
+				"type":      lang().LessonTypes[ent.Type],
+				"classroom": ent.Classroom,
+			}
+		}
+
+		// Single changed lesson is described field by field.
+		if len(removed) == 1 && len(added) == 1 {
+			oldEnt, newEnt := removed[0], added[0]
+			fieldChange := func(tmpl, oldVal, newVal string) {
+				if oldVal == newVal {
+					return
+				}
+				a := args(newEnt)
+				a["old"] = oldVal
+				a["new"] = newVal
+				res = append(res, pyfmt.Must(tmpl, a))
+			}
+			fieldChange(lang().Changes.Name, oldEnt.Name, newEnt.Name)
+			fieldChange(lang().Changes.Type, lang().LessonTypes[oldEnt.Type], lang().LessonTypes[newEnt.Type])
+			fieldChange(lang().Changes.Classroom, oldEnt.Classroom, newEnt.Classroom)
+			fieldChange(lang().Changes.Lecturer, oldEnt.Lecturer, newEnt.Lecturer)
+			continue
+		}
+
+		for _, ent := range removed {
+			res = append(res, pyfmt.Must(lang().Changes.Removed, args(ent)))
+		}
+		for _, ent := range added {
+			res = append(res, pyfmt.Must(lang().Changes.Added, args(ent)))
+		}
+	}
+	return res
+}
+
+// notifyChanges sends description of timetable changes to group's
+// notification chats and subscribers.
+func notifyChanges(group string, changes []DayChange) {
+	lines := []string{}
+	for _, change := range changes {
+		lines = append(lines, diffEntries(change)...)
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	now := time.Now().In(timezone)
+	chats := append([]int64(nil), config().Groups[group].NotifyChats...)
+	for _, sub := range allSubscriptions() {
+		if sub.Events&EventChanges == 0 || sub.isQuiet(now) {
+			continue
+		}
+		if chatGroup(sub.ChatID) == group {
+			chats = append(chats, sub.ChatID)
+		}
+	}
+
+	key := notifyKey(group, "changes:"+changes[0].Day.Format(dayKeyFormat), now)
+	broadcastNotify(chats, key, lang().Changes.Header+strings.Join(lines, "\n"))
+}
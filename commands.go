@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/pkg/errors"
 	"github.com/slongfield/pyfmt"
 	"log"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -18,8 +20,20 @@ func replyTo(msg *tgbotapi.Message, text string, markup interface{}) (tgbotapi.M
 	return bot.Send(reply)
 }
 
+// Role is a permission level required to use command.
+type Role int
+
+const (
+	// RoleUser commands can be used by anyone.
+	RoleUser Role = 0
+	// RoleAdmin commands can be used only by bot admins (listed in config).
+	// Commands changing timetable must use it: overrides are per group, so
+	// they are seen by all chats of group, not just one where they were made.
+	RoleAdmin Role = 1
+)
+
 func adminCheck(uid int) bool {
-	for _, id := range config.Admins {
+	for _, id := range config().Admins {
 		if id == uid {
 			return true
 		}
@@ -27,24 +41,74 @@ func adminCheck(uid int) bool {
 	return false
 }
 
+func chatAdminCheck(chat *tgbotapi.Chat, uid int) (bool, error) {
+	if !chat.IsGroup() && !chat.IsSuperGroup() {
+		return false, nil
+	}
+	member, err := bot.GetChatMember(tgbotapi.ChatConfigWithUser{ChatID: chat.ID, UserID: uid})
+	if err != nil {
+		return false, errors.Wrapf(err, "getChatMember chatid=%d, uid=%d", chat.ID, uid)
+	}
+	return member.IsCreator() || member.IsAdministrator(), nil
+}
+
+// hasRole checks whether sender of msg is allowed to use commands with
+// specified role.
+func hasRole(msg *tgbotapi.Message, role Role) bool {
+	if role == RoleUser {
+		return true
+	}
+	return msg.From != nil && adminCheck(msg.From.ID)
+}
+
+// canConfigureChat checks whether sender of msg can change chat's
+// settings. Anyone can do it in private chat, but only admins can
+// change them for everybody in group chat.
+func canConfigureChat(msg *tgbotapi.Message) (bool, error) {
+	if msg.Chat.IsPrivate() {
+		return true, nil
+	}
+	if msg.From == nil {
+		return false, nil
+	}
+	if adminCheck(msg.From.ID) {
+		return true, nil
+	}
+	return chatAdminCheck(msg.Chat, msg.From.ID)
+}
+
 func reportError(e error, replyToTgt *tgbotapi.Message) {
 	if _, err := replyTo(replyToTgt, fmt.Sprintf("*Что-то сломалось*\n```\n%s\n```", e), nil); err != nil {
 		log.Println("ERROR:", err)
 	}
 }
 
-func helpCmd(msg *tgbotapi.Message) error {
-	_, err := replyTo(msg, lang.Help, nil)
+// helpCmd sends list of commands or, if command is specified, its usage.
+// /start with parameter (e.g. from inline mode) shows usage too.
+func helpCmd(msg *tgbotapi.Message, args cmdArgs) error {
+	if cmd, prs := commandsByName[strings.TrimPrefix(args.str("command"), "/")]; prs {
+		return reply(msg, cmd.usage(msg))
+	}
+
+	text := pyfmt.Must(lang().Help, map[string]interface{}{
+		"commands": commandsHelp(func(r Role) bool { return r == RoleUser }),
+	})
+	_, err := replyTo(msg, text, nil)
 	return err
 }
 
-func adminHelpCmd(msg *tgbotapi.Message) error {
-	_, err := replyTo(msg, lang.AdminHelp, nil)
+func adminHelpCmd(msg *tgbotapi.Message, _ cmdArgs) error {
+	text := pyfmt.Must(lang().AdminHelp, map[string]interface{}{
+		"commands": commandsHelp(func(r Role) bool { return r != RoleUser }),
+	})
+	_, err := replyTo(msg, text, nil)
 	return err
 }
 
-func formatTimetable(date time.Time, entries []Entry) string {
-	hdr := pyfmt.Must(lang.Replies.TimetableHeader, map[string]interface{}{
+// formatTimetable formats entries for date. If entries were retrieved too
+// long ago, note about that is appended.
+func formatTimetable(date time.Time, entries []Entry, retrievedOn time.Time) string {
+	hdr := pyfmt.Must(lang().Replies.TimetableHeader, map[string]interface{}{
 		"date": date.Format("_2 January  2006"),
 	})
 	entriesStr := make([]string, len(entries))
@@ -52,43 +116,45 @@ func formatTimetable(date time.Time, entries []Entry) string {
 		entriesStr[i] = formatEntry(entry)
 	}
 	if len(entriesStr) == 0 {
-		entriesStr = append(entriesStr, lang.Replies.Empty)
+		entriesStr = append(entriesStr, lang().Replies.Empty)
 	}
-	return hdr + strings.Join(entriesStr, "\n\n")
+	return hdr + strings.Join(entriesStr, "\n\n") + outdatedNote(retrievedOn)
 }
 
+func outdatedNote(retrievedOn time.Time) string {
+	if !IsOutdated(retrievedOn) {
+		return ""
+	}
+	return pyfmt.Must(lang().Replies.Outdated, map[string]interface{}{
+		"time": retrievedOn.In(timezone).Format("02.01 15:04"),
+	})
+}
+
+// makeSchedButtons returns buttons switching to previous and next day, and
+// to week containing date.
 func makeSchedButtons(date time.Time) tgbotapi.InlineKeyboardMarkup {
 	return tgbotapi.NewInlineKeyboardMarkup([]tgbotapi.InlineKeyboardButton{
 		tgbotapi.NewInlineKeyboardButtonData("\u25C0",
 			date.AddDate(0, 0, -1).Format("02.01.06")),
+		tgbotapi.NewInlineKeyboardButtonData("\U0001F4C5",
+			weekCallbackPrefix+date.Format("02.01.06")),
 		tgbotapi.NewInlineKeyboardButtonData("\u25B6",
 			date.AddDate(0, 0, 1).Format("02.01.06"))})
 }
 
-func scheduleCmd(msg *tgbotapi.Message) error {
-	splitten := strings.Split(msg.Text, " ")
-	if len(splitten) != 2 {
-		if _, err := replyTo(msg, lang.Usage.Schedule, nil); err != nil {
-			return errors.Wrapf(err, "replyTo chatid=%d, msgid=%d", msg.Chat.ID, msg.MessageID)
-		}
-		return nil
+func scheduleCmd(msg *tgbotapi.Message, args cmdArgs) error {
+	day := args.date("date")
+	group, ok, err := msgGroup(msg)
+	if !ok {
+		return err
 	}
-
-	day, err := time.ParseInLocation("02.01.06", splitten[1], timezone)
-	if err != nil {
-		if _, err := replyTo(msg, lang.Replies.InvalidDate, nil); err != nil {
-			return errors.Wrapf(err, "replyTo chatid=%d, msgid=%d", msg.Chat.ID, msg.MessageID)
-		}
-		return nil
-	}
-
-	entries, err := cache.OnDay(day)
+	entries, retrievedOn, err := cache.OnDayWithAge(group, day)
 	if err != nil {
 		reportError(err, msg)
 		return err
 	}
 
-	_, err = replyTo(msg, formatTimetable(day, entries), makeSchedButtons(day))
+	_, err = replyTo(msg, formatTimetable(day, entries, retrievedOn), makeSchedButtons(day))
 	if err != nil {
 		return errors.Wrapf(err, "replyTo chatid=%d, msgid=%d", msg.Chat.ID, msg.MessageID)
 	}
@@ -96,15 +162,20 @@ func scheduleCmd(msg *tgbotapi.Message) error {
 	return nil
 }
 
-func todayCmd(msg *tgbotapi.Message) error {
+func todayCmd(msg *tgbotapi.Message, _ cmdArgs) error {
+	group, ok, err := msgGroup(msg)
+	if !ok {
+		return err
+	}
+
 	now := time.Now().In(timezone)
-	entries, err := cache.OnDay(now)
+	entries, retrievedOn, err := cache.OnDayWithAge(group, now)
 	if err != nil {
 		reportError(err, msg)
 		return err
 	}
 
-	_, err = replyTo(msg, formatTimetable(now, entries), makeSchedButtons(now))
+	_, err = replyTo(msg, formatTimetable(now, entries, retrievedOn), makeSchedButtons(now))
 	if err != nil {
 		return errors.Wrapf(err, "replyTo chatid=%d, msgid=%d", msg.Chat.ID, msg.MessageID)
 	}
@@ -112,15 +183,20 @@ func todayCmd(msg *tgbotapi.Message) error {
 	return nil
 }
 
-func tomorrowCmd(msg *tgbotapi.Message) error {
+func tomorrowCmd(msg *tgbotapi.Message, _ cmdArgs) error {
+	group, ok, err := msgGroup(msg)
+	if !ok {
+		return err
+	}
+
 	tomorrow := time.Now().In(timezone).AddDate(0, 0, 1)
-	entries, err := cache.OnDay(tomorrow)
+	entries, retrievedOn, err := cache.OnDayWithAge(group, tomorrow)
 	if err != nil {
 		reportError(err, msg)
 		return err
 	}
 
-	_, err = replyTo(msg, formatTimetable(tomorrow, entries), makeSchedButtons(tomorrow))
+	_, err = replyTo(msg, formatTimetable(tomorrow, entries, retrievedOn), makeSchedButtons(tomorrow))
 	if err != nil {
 		return errors.Wrapf(err, "replyTo chatid=%d, msgid=%d", msg.Chat.ID, msg.MessageID)
 	}
@@ -128,14 +204,19 @@ func tomorrowCmd(msg *tgbotapi.Message) error {
 	return nil
 }
 
-func nextCmd(msg *tgbotapi.Message) error {
+func nextCmd(msg *tgbotapi.Message, _ cmdArgs) error {
+	group, ok, err := msgGroup(msg)
+	if !ok {
+		return err
+	}
+
 	now := time.Now().In(timezone)
 
 	var entry *Entry
-	for _, slot := range config.TimeslotsBegin {
+	for _, slot := range config().TimeslotsBegin {
 		if TimeSlotSet(now, slot).After(now) {
 			var err error
-			entry, err = cache.ExactGet(TimeSlotSet(now, slot))
+			entry, err = cache.ExactGet(group, TimeSlotSet(now, slot))
 			if err != nil {
 				reportError(err, msg)
 				return err
@@ -146,7 +227,7 @@ func nextCmd(msg *tgbotapi.Message) error {
 		}
 	}
 	if entry == nil {
-		if _, err := replyTo(msg, lang.Replies.NoMoreLessonsToday, nil); err != nil {
+		if _, err := replyTo(msg, lang().Replies.NoMoreLessonsToday, nil); err != nil {
 			return errors.Wrapf(err, "replyTo chatid=%d, msgid=%d", msg.Chat.ID, msg.MessageID)
 		}
 		return nil
@@ -158,14 +239,16 @@ func nextCmd(msg *tgbotapi.Message) error {
 	return nil
 }
 
-func timetableCmd(msg *tgbotapi.Message) error {
-	res := make([]string, len(config.TimeslotsBegin))
-	for i := 0; i < len(config.TimeslotsBegin); i++ {
-		res[i] = pyfmt.Must(lang.TimeslotFormat, map[string]interface{}{
+func timetableCmd(msg *tgbotapi.Message, _ cmdArgs) error {
+	conf := config()
+	now := time.Now().In(timezone)
+	res := make([]string, len(conf.TimeslotsBegin))
+	for i := range conf.TimeslotsBegin {
+		res[i] = pyfmt.Must(lang().TimeslotFormat, map[string]interface{}{
 			"num":   i + 1,
-			"start": TimeSlotSet(time.Now().In(timezone), config.TimeslotsBegin[i]).Format("15:04"),
-			"end":   TimeSlotSet(time.Now().In(timezone), config.TimeslotsEnd[i]).Format("15:04"),
-			"break": TimeSlotSet(time.Now().In(timezone), config.TimeslotsBreak[i]).Format("15:04"),
+			"start": TimeSlotSet(now, conf.TimeslotsBegin[i]).Format("15:04"),
+			"end":   TimeSlotSet(now, conf.TimeslotsEnd[i]).Format("15:04"),
+			"break": TimeSlotSet(now, conf.TimeslotsBreak[i]).Format("15:04"),
 		})
 	}
 	if _, err := replyTo(msg, strings.Join(res, "\n"), nil); err != nil {
@@ -181,18 +264,36 @@ func handleCallbackQuery(query *tgbotapi.CallbackQuery) error {
 	if query.Message == nil {
 		return errors.New("message too old")
 	}
-	date, err := time.ParseInLocation("02.01.06", query.Data, timezone)
+	isWeek := strings.HasPrefix(query.Data, weekCallbackPrefix)
+	date, err := time.ParseInLocation("02.01.06", strings.TrimPrefix(query.Data, weekCallbackPrefix), timezone)
 	if err != nil {
 		return errors.Wrap(err, "parse data date")
 	}
+	group := chatGroup(query.Message.Chat.ID)
+	if group == "" {
+		return errors.New("no group bound to chat")
+	}
 
-	entries, err := cache.OnDay(date)
-	if err != nil {
-		return errors.Wrap(err, "cache query")
+	var text string
+	var newReplyMarkup tgbotapi.InlineKeyboardMarkup
+	if isWeek {
+		from, _ := weekBounds(date)
+		week, retrievedOn, err := weekEntries(group, from)
+		if err != nil {
+			return errors.Wrap(err, "cache query")
+		}
+		text = formatWeek(from, week, retrievedOn)
+		newReplyMarkup = makeWeekButtons(from)
+	} else {
+		entries, retrievedOn, err := cache.OnDayWithAge(group, date)
+		if err != nil {
+			return errors.Wrap(err, "cache query")
+		}
+		text = formatTimetable(date, entries, retrievedOn)
+		newReplyMarkup = makeSchedButtons(date)
 	}
 
-	cfg := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, formatTimetable(date, entries))
-	newReplyMarkup := makeSchedButtons(date)
+	cfg := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
 	cfg.ParseMode = "Markdown"
 	cfg.ReplyMarkup = &newReplyMarkup
 
@@ -206,30 +307,399 @@ func handleCallbackQuery(query *tgbotapi.CallbackQuery) error {
 	return nil
 }
 
-func evictCmd(msg *tgbotapi.Message) error {
-	splitten := strings.Split(msg.Text, " ")
-	if len(splitten) != 2 {
-		if _, err := replyTo(msg, lang.Usage.Evict, nil); err != nil {
-			return errors.Wrapf(err, "replyTo chatid=%d, msgid=%d", msg.Chat.ID, msg.MessageID)
+func evictCmd(msg *tgbotapi.Message, args cmdArgs) error {
+	day := args.date("date")
+	group, ok, err := msgGroup(msg)
+	if !ok {
+		return err
+	}
+	cache.Evict(group, day)
+	if _, err := replyTo(msg, "OK!", nil); err != nil {
+		return errors.Wrapf(err, "replyTo chatid=%d, msgid=%d", msg.Chat.ID, msg.MessageID)
+	}
+	return nil
+}
+
+// reply sends text in reply to msg and wraps error (if any) with message info.
+func reply(msg *tgbotapi.Message, text string) error {
+	if _, err := replyTo(msg, text, nil); err != nil {
+		return errors.Wrapf(err, "replyTo chatid=%d, msgid=%d", msg.Chat.ID, msg.MessageID)
+	}
+	return nil
+}
+
+// msgGroup returns group bound to chat where msg was sent. If there is no
+// such group, reply is sent and false is returned.
+func msgGroup(msg *tgbotapi.Message) (string, bool, error) {
+	group := chatGroup(msg.Chat.ID)
+	if group == "" {
+		return "", false, reply(msg, lang().Replies.NoGroup)
+	}
+	return group, true, nil
+}
+
+// lessonNum parses lesson number argument used by timetable editing
+// commands. Error reply is sent if it's invalid.
+func lessonNum(msg *tgbotapi.Message, numStr string) (int, bool, error) {
+	num, err := strconv.Atoi(numStr)
+	if err != nil || num < 1 || num > len(config().TimeslotsBegin) {
+		return 0, false, reply(msg, lang().Replies.InvalidLessonNum)
+	}
+	return num, true, nil
+}
+
+func addCmd(msg *tgbotapi.Message, args cmdArgs) error {
+	day := args.date("date")
+	num, ok, err := lessonNum(msg, args.str("num"))
+	if !ok {
+		return err
+	}
+	group, ok, err := msgGroup(msg)
+	if !ok {
+		return err
+	}
+
+	fields := strings.Split(args.str("entry"), ";")
+	if len(fields) != 4 {
+		return reply(msg, lang().Usage["add"])
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	lessonType, prs := lang().LessonTypeStrs[strings.ToLower(fields[0])]
+	if !prs {
+		return reply(msg, lang().Replies.InvalidLessonType)
+	}
+
+	err = cache.AddOverride(Override{
+		Group:     group,
+		Day:       day,
+		Num:       num,
+		Action:    OverrideAdd,
+		Type:      lessonType,
+		Classroom: fields[1],
+		Name:      fields[2],
+		Lecturer:  fields[3],
+	})
+	if err != nil {
+		reportError(err, msg)
+		return err
+	}
+	return reply(msg, "OK!")
+}
+
+func editCmd(msg *tgbotapi.Message, args cmdArgs) error {
+	day := args.date("date")
+	num, ok, err := lessonNum(msg, args.str("num"))
+	if !ok {
+		return err
+	}
+	group, ok, err := msgGroup(msg)
+	if !ok {
+		return err
+	}
+
+	o := Override{Group: group, Day: day, Num: num, Action: OverrideEdit, Type: -1}
+	value := args.str("value")
+	switch strings.ToLower(args.str("field")) {
+	case "type":
+		lessonType, prs := lang().LessonTypeStrs[strings.ToLower(value)]
+		if !prs {
+			return reply(msg, lang().Replies.InvalidLessonType)
 		}
-		return nil
+		o.Type = lessonType
+	case "classroom":
+		o.Classroom = value
+	case "lecturer":
+		o.Lecturer = value
+	case "name":
+		o.Name = value
+	default:
+		return reply(msg, lang().Usage["edit"])
 	}
 
-	day, err := time.ParseInLocation("02.01.06", splitten[1], timezone)
+	entries, err := cache.SlotEntries(group, TimeSlotSet(day, config().TimeslotsBegin[num-1]))
 	if err != nil {
-		if _, err := replyTo(msg, lang.Replies.InvalidDate, nil); err != nil {
-			return errors.Wrapf(err, "replyTo chatid=%d, msgid=%d", msg.Chat.ID, msg.MessageID)
+		reportError(err, msg)
+		return err
+	}
+	if len(entries) == 0 {
+		return reply(msg, lang().Replies.NoSuchLesson)
+	}
+
+	if err := cache.AddOverride(o); err != nil {
+		reportError(err, msg)
+		return err
+	}
+	return reply(msg, "OK!")
+}
+
+func cancelCmd(msg *tgbotapi.Message, args cmdArgs) error {
+	day := args.date("date")
+	num, ok, err := lessonNum(msg, args.str("num"))
+	if !ok {
+		return err
+	}
+	group, ok, err := msgGroup(msg)
+	if !ok {
+		return err
+	}
+
+	if err := cache.AddOverride(Override{Group: group, Day: day, Num: num, Action: OverrideCancel}); err != nil {
+		reportError(err, msg)
+		return err
+	}
+	return reply(msg, "OK!")
+}
+
+func moveCmd(msg *tgbotapi.Message, args cmdArgs) error {
+	fromDay, toDay := args.date("date"), args.date("newdate")
+	fromNum, ok, err := lessonNum(msg, args.str("num"))
+	if !ok {
+		return err
+	}
+	toNum, ok, err := lessonNum(msg, args.str("newnum"))
+	if !ok {
+		return err
+	}
+	group, ok, err := msgGroup(msg)
+	if !ok {
+		return err
+	}
+
+	entries, err := cache.SlotEntries(group, TimeSlotSet(fromDay, config().TimeslotsBegin[fromNum-1]))
+	if err != nil {
+		reportError(err, msg)
+		return err
+	}
+	if len(entries) == 0 {
+		return reply(msg, lang().Replies.NoSuchLesson)
+	}
+
+	// Moved lessons are copies of original ones, so they will not follow
+	// changes in source for original day. All parallel lessons are moved.
+	if err := cache.AddOverride(Override{Group: group, Day: fromDay, Num: fromNum, Action: OverrideCancel}); err != nil {
+		reportError(err, msg)
+		return err
+	}
+	for i, entry := range entries {
+		// First one replaces lessons at new time, others are added to it.
+		action := OverrideAppend
+		if i == 0 {
+			action = OverrideAdd
+		}
+		err = cache.AddOverride(Override{
+			Group:     group,
+			Day:       toDay,
+			Num:       toNum,
+			Action:    action,
+			Type:      entry.Type,
+			Classroom: entry.Classroom,
+			Lecturer:  entry.Lecturer,
+			Name:      entry.Name,
+		})
+		if err != nil {
+			reportError(err, msg)
+			return err
 		}
-		return nil
 	}
+	return reply(msg, "OK!")
+}
 
-	cache.Evict(day)
-	if _, err := replyTo(msg, "OK!", nil); err != nil {
-		return errors.Wrapf(err, "replyTo chatid=%d, msgid=%d", msg.Chat.ID, msg.MessageID)
+func resetCmd(msg *tgbotapi.Message, args cmdArgs) error {
+	day := args.date("date")
+	num, ok, err := lessonNum(msg, args.str("num"))
+	if !ok {
+		return err
+	}
+	group, ok, err := msgGroup(msg)
+	if !ok {
+		return err
+	}
+
+	if err := cache.ResetOverrides(group, day, num); err != nil {
+		reportError(err, msg)
+		return err
+	}
+	return reply(msg, "OK!")
+}
+
+func setGroupCmd(msg *tgbotapi.Message, args cmdArgs) error {
+	if !args.has("group") {
+		return reply(msg, commandsByName["setgroup"].usage(msg))
+	}
+	group := args.str("group")
+	if _, prs := config().Groups[group]; !prs {
+		return reply(msg, lang().Replies.UnknownGroup)
+	}
+
+	allowed, err := canConfigureChat(msg)
+	if err != nil {
+		reportError(err, msg)
+		return err
+	}
+	if !allowed {
+		return reply(msg, lang().Replies.MissingPermissions)
+	}
+
+	if err := setChatGroup(msg.Chat.ID, group); err != nil {
+		reportError(err, msg)
+		return err
+	}
+	return reply(msg, "OK!")
+}
+
+func formatSubscription(sub Subscription) string {
+	quiet := "-"
+	if sub.QuietFrom != sub.QuietTo {
+		quiet = sub.QuietFrom.String() + "-" + sub.QuietTo.String()
+	}
+	return pyfmt.Must(lang().NotifySettings, map[string]interface{}{
+		"lead":    sub.LeadMins,
+		"events":  sub.Events.String(),
+		"quiet":   quiet,
+		"summary": sub.SummaryAt.String(),
+	})
+}
+
+func subscribeCmd(msg *tgbotapi.Message, _ cmdArgs) error {
+	if !msg.Chat.IsPrivate() {
+		return reply(msg, lang().Replies.PrivateOnly)
+	}
+	if sub, prs := getSubscription(msg.Chat.ID); prs {
+		return reply(msg, formatSubscription(sub))
+	}
+
+	sub := defaultSubscription(msg.Chat.ID)
+	if err := saveSubscription(sub); err != nil {
+		reportError(err, msg)
+		return err
+	}
+	return reply(msg, lang().Replies.Subscribed+"\n\n"+formatSubscription(sub))
+}
+
+func unsubscribeCmd(msg *tgbotapi.Message, _ cmdArgs) error {
+	if _, prs := getSubscription(msg.Chat.ID); !prs {
+		return reply(msg, lang().Replies.NotSubscribed)
+	}
+	if err := removeSubscription(msg.Chat.ID); err != nil {
+		reportError(err, msg)
+		return err
+	}
+	return reply(msg, lang().Replies.Unsubscribed)
+}
+
+func notifyCmd(msg *tgbotapi.Message, args cmdArgs) error {
+	sub, prs := getSubscription(msg.Chat.ID)
+	if !prs {
+		return reply(msg, lang().Replies.NotSubscribed)
+	}
+
+	if !args.has("setting") {
+		return reply(msg, formatSubscription(sub))
+	}
+	if !args.has("value") {
+		return reply(msg, lang().Usage["notify"])
+	}
+
+	value := args.str("value")
+	switch strings.ToLower(args.str("setting")) {
+	case "lead":
+		mins, err := strconv.Atoi(value)
+		if err != nil || mins < 0 || mins > 24*60 {
+			return reply(msg, lang().Usage["notify"])
+		}
+		sub.LeadMins = mins
+	case "events":
+		events, err := parseEvents(value)
+		if err != nil {
+			return reply(msg, lang().Usage["notify"])
+		}
+		sub.Events = events
+	case "quiet":
+		if value == "off" {
+			sub.QuietFrom, sub.QuietTo = TimeSlot{}, TimeSlot{}
+			break
+		}
+		bounds := strings.Split(value, "-")
+		if len(bounds) != 2 {
+			return reply(msg, lang().Usage["notify"])
+		}
+		from, err := parseTimeSlot(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return reply(msg, lang().Usage["notify"])
+		}
+		to, err := parseTimeSlot(strings.TrimSpace(bounds[1]))
+		if err != nil {
+			return reply(msg, lang().Usage["notify"])
+		}
+		sub.QuietFrom, sub.QuietTo = from, to
+	case "summary":
+		at, err := parseTimeSlot(value)
+		if err != nil {
+			return reply(msg, lang().Usage["notify"])
+		}
+		sub.SummaryAt = at
+	default:
+		return reply(msg, lang().Usage["notify"])
+	}
+
+	if err := saveSubscription(sub); err != nil {
+		reportError(err, msg)
+		return err
+	}
+	return reply(msg, formatSubscription(sub))
+}
+
+func icsCmd(msg *tgbotapi.Message, args cmdArgs) error {
+	group, ok, err := msgGroup(msg)
+	if !ok {
+		return err
+	}
+
+	// Current and next week by default.
+	from, _ := weekBounds(StripTime(time.Now().In(timezone), timezone))
+	to := from.AddDate(0, 0, 13)
+
+	if args.has("from") {
+		from = args.date("from")
+		to = from.AddDate(0, 0, 6)
+	}
+	if args.has("to") {
+		to = args.date("to")
+	}
+	if to.Before(from) || to.Sub(from) > maxICSDays*24*time.Hour {
+		return reply(msg, pyfmt.Must(lang().Replies.InvalidRange, map[string]interface{}{
+			"max": maxICSDays,
+		}))
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeICS(buf, group, from, to); err != nil {
+		reportError(err, msg)
+		return err
+	}
+
+	doc := tgbotapi.NewDocumentUpload(msg.Chat.ID, tgbotapi.FileBytes{
+		Name:  fmt.Sprintf("%s_%s-%s.ics", group, from.Format("020106"), to.Format("020106")),
+		Bytes: buf.Bytes(),
+	})
+	doc.ReplyToMessageID = msg.MessageID
+	if _, err := bot.Send(doc); err != nil {
+		return errors.Wrapf(err, "send document chatid=%d", msg.Chat.ID)
 	}
 	return nil
 }
 
+func statsCmd(msg *tgbotapi.Message, _ cmdArgs) error {
+	stats := cache.Stats()
+	return reply(msg, pyfmt.Must(lang().Replies.CacheStats, map[string]interface{}{
+		"downloads": stats.Downloads,
+		"failed":    stats.Failed,
+		"coalesced": stats.Coalesced,
+	}))
+}
+
 func easterEgg(msg *tgbotapi.Message) error {
 	rpl := tgbotapi.NewStickerShare(msg.Chat.ID, "CAADAQADcykAAnj8xgXDDcRyRS7wuAI")
 	bot.Send(rpl)
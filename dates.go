@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// dateLayouts are tried in order by parseDate. Layouts without year use
+// current year.
+var dateLayouts = []string{"2.1.06", "2.1.2006", "2006-01-02", "2.1"}
+
+var weekdayWords = map[string]time.Weekday{
+	"monday": time.Monday, "mon": time.Monday,
+	"tuesday": time.Tuesday, "tue": time.Tuesday,
+	"wednesday": time.Wednesday, "wed": time.Wednesday,
+	"thursday": time.Thursday, "thu": time.Thursday,
+	"friday": time.Friday, "fri": time.Friday,
+	"saturday": time.Saturday, "sat": time.Saturday,
+	"sunday": time.Sunday, "sun": time.Sunday,
+
+	"понедельник": time.Monday, "пн": time.Monday,
+	"вторник": time.Tuesday, "вт": time.Tuesday,
+	"среда": time.Wednesday, "среду": time.Wednesday, "ср": time.Wednesday,
+	"четверг": time.Thursday, "чт": time.Thursday,
+	"пятница": time.Friday, "пятницу": time.Friday, "пт": time.Friday,
+	"суббота": time.Saturday, "субботу": time.Saturday, "сб": time.Saturday,
+	"воскресенье": time.Sunday, "вс": time.Sunday,
+}
+
+// dayOffsetWords are dates relative to today.
+var dayOffsetWords = map[string]int{
+	"yesterday":          -1,
+	"today":              0,
+	"tomorrow":           1,
+	"day after tomorrow": 2,
+	"вчера":              -1,
+	"сегодня":            0,
+	"завтра":             1,
+	"послезавтра":        2,
+}
+
+// weekShiftWords select week in "next friday"-like dates.
+var weekShiftWords = map[string]int{
+	"this":      0,
+	"этот":      0,
+	"эта":       0,
+	"это":       0,
+	"эту":       0,
+	"next":      1,
+	"след":      1,
+	"следующий": 1,
+	"следующая": 1,
+	"следующее": 1,
+	"следующую": 1,
+	"last":      -1,
+	"прошлый":   -1,
+	"прошлая":   -1,
+	"прошлое":   -1,
+	"прошлую":   -1,
+}
+
+// unitDays maps units used in "in 2 days"-like dates to amount of days.
+var unitDays = map[string]int{
+	"day": 1, "days": 1,
+	"week": 7, "weeks": 7,
+	"день": 1, "дня": 1, "дней": 1,
+	"неделю": 7, "недели": 7, "недель": 7,
+}
+
+// parseDate parses date specified by user. Supported forms are:
+//   - 12.09.18, 12.09.2018, 2018-09-12 and 12.09 (current year);
+//   - today, tomorrow, yesterday and their Russian counterparts;
+//   - weekday names, e.g. "friday" or "пт" - nearest such day, starting from
+//     today; "next friday" or "this fri" - day of next or current week;
+//   - +3, -1, "in 2 days", "через 2 недели" - relative to today.
+//
+// Returned time is midnight in timezone.
+func parseDate(str string, now time.Time) (time.Time, error) {
+	today := StripTime(now.In(timezone), timezone)
+	words := strings.Fields(strings.ToLower(str))
+	norm := strings.Join(words, " ")
+	if len(words) == 0 {
+		return time.Time{}, errors.New("empty date")
+	}
+
+	if offset, prs := dayOffsetWords[norm]; prs {
+		return today.AddDate(0, 0, offset), nil
+	}
+
+	if len(words) == 1 && (norm[0] == '+' || norm[0] == '-') {
+		offset, err := strconv.Atoi(norm)
+		if err != nil {
+			return time.Time{}, errors.Errorf("invalid offset: %s", str)
+		}
+		return today.AddDate(0, 0, offset), nil
+	}
+
+	if len(words) == 3 && (words[0] == "in" || words[0] == "через") {
+		amount, err := strconv.Atoi(words[1])
+		unit, prs := unitDays[words[2]]
+		if err != nil || !prs {
+			return time.Time{}, errors.Errorf("invalid relative date: %s", str)
+		}
+		return today.AddDate(0, 0, amount*unit), nil
+	}
+
+	if weekday, prs := weekdayWords[strings.TrimSuffix(words[len(words)-1], ".")]; prs {
+		switch len(words) {
+		case 1:
+			diff := (int(weekday) - int(today.Weekday()) + 7) % 7
+			return today.AddDate(0, 0, diff), nil
+		case 2:
+			shift, prs := weekShiftWords[strings.TrimSuffix(words[0], ".")]
+			if !prs {
+				return time.Time{}, errors.Errorf("invalid date: %s", str)
+			}
+			monday, _ := weekBounds(today)
+			// Weekdays are counted from Monday.
+			return monday.AddDate(0, 0, 7*shift+(int(weekday)+6)%7), nil
+		}
+	}
+
+	for _, layout := range dateLayouts {
+		t, err := time.ParseInLocation(layout, norm, timezone)
+		if err != nil {
+			continue
+		}
+		if t.Year() == 0 {
+			t = time.Date(today.Year(), t.Month(), t.Day(), 0, 0, 0, 0, timezone)
+		}
+		return t, nil
+	}
+	return time.Time{}, errors.Errorf("invalid date: %s", str)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	timezone = time.UTC
+	// Wednesday.
+	now := time.Date(2018, 9, 12, 15, 4, 5, 0, time.UTC)
+	day := func(month time.Month, d int) time.Time {
+		return time.Date(2018, month, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		str  string
+		want time.Time
+	}{
+		{"12.09.18", day(9, 12)},
+		{"1.10.2018", day(10, 1)},
+		{"2018-09-30", day(9, 30)},
+		{"25.12", day(12, 25)},
+
+		{"today", day(9, 12)},
+		{"Tomorrow", day(9, 13)},
+		{"yesterday", day(9, 11)},
+		{"day after tomorrow", day(9, 14)},
+		{"  day  after tomorrow ", day(9, 14)},
+		{"завтра", day(9, 13)},
+		{"послезавтра", day(9, 14)},
+
+		{"+3", day(9, 15)},
+		{"-1", day(9, 11)},
+		{"in 2 days", day(9, 14)},
+		{"in 1 week", day(9, 19)},
+		{"через 2 недели", day(9, 26)},
+
+		{"wednesday", day(9, 12)},
+		{"friday", day(9, 14)},
+		{"mon", day(9, 17)},
+		{"пт", day(9, 14)},
+		{"вс.", day(9, 16)},
+		{"this mon", day(9, 10)},
+		{"next friday", day(9, 21)},
+		{"last fri", day(9, 7)},
+		{"следующую среду", day(9, 19)},
+		{"прошлый понедельник", day(9, 3)},
+	}
+	for _, c := range cases {
+		got, err := parseDate(c.str, now)
+		if err != nil {
+			t.Errorf("parseDate(%q): unexpected error: %v", c.str, err)
+			continue
+		}
+		if !got.Equal(c.want) {
+			t.Errorf("parseDate(%q) = %v, want %v", c.str, got, c.want)
+		}
+	}
+}
+
+func TestParseDateInvalid(t *testing.T) {
+	timezone = time.UTC
+	now := time.Date(2018, 9, 12, 15, 4, 5, 0, time.UTC)
+
+	for _, str := range []string{
+		"",
+		"   ",
+		"foo",
+		"+x",
+		"in 2 years",
+		"in two days",
+		"next",
+		"soon friday",
+		"next big friday",
+		"32.13",
+		"today tomorrow",
+	} {
+		if got, err := parseDate(str, now); err == nil {
+			t.Errorf("parseDate(%q) = %v, want error", str, got)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/slongfield/pyfmt"
+)
+
+// Digest is whole day timetable sent to chat at specified time.
+type Digest struct {
+	ChatID int64
+	At     TimeSlot
+	// DayOffset selects day relative to current one: 0 is today,
+	// 1 is tomorrow.
+	DayOffset int
+	// Group is group whose timetable is sent. Empty means group of chat,
+	// digests from config use their group even if chat has other one.
+	Group string
+}
+
+// DigestConfig is digest sent to all notify_chats of group.
+type DigestConfig struct {
+	At  TimeSlot `yaml:"at"`
+	Day string   `yaml:"day"`
+}
+
+// digestDays maps day names used in config and /digest to day offsets.
+var digestDays = map[string]int{
+	"today":    0,
+	"tomorrow": 1,
+}
+
+func digestDayName(offset int) string {
+	for name, o := range digestDays {
+		if o == offset {
+			return name
+		}
+	}
+	return "?"
+}
+
+var (
+	digestsLck sync.RWMutex
+	// digests contains digests configured using /digest.
+	digests = make(map[int64][]Digest)
+)
+
+func loadDigests() error {
+	if storage == nil {
+		return nil
+	}
+	list, err := storage.LoadDigests()
+	if err != nil {
+		return err
+	}
+
+	digestsLck.Lock()
+	defer digestsLck.Unlock()
+	for _, d := range list {
+		digests[d.ChatID] = append(digests[d.ChatID], d)
+	}
+	return nil
+}
+
+func chatDigests(chatID int64) []Digest {
+	digestsLck.RLock()
+	defer digestsLck.RUnlock()
+	return append([]Digest(nil), digests[chatID]...)
+}
+
+// setDigest adds digest, replacing one with same time (if any).
+func setDigest(d Digest) error {
+	if storage != nil {
+		if err := storage.SaveDigest(d); err != nil {
+			return errors.Wrap(err, "save digest")
+		}
+	}
+
+	digestsLck.Lock()
+	defer digestsLck.Unlock()
+	list := []Digest{}
+	for _, old := range digests[d.ChatID] {
+		if old.At != d.At {
+			list = append(list, old)
+		}
+	}
+	list = append(list, d)
+	sort.Slice(list, func(i, j int) bool {
+		return slotToMins(list[i].At) < slotToMins(list[j].At)
+	})
+	digests[d.ChatID] = list
+	return nil
+}
+
+// removeDigests removes chat's digest sent at specified time or all of
+// chat's digests if at is nil.
+func removeDigests(chatID int64, at *TimeSlot) error {
+	if storage != nil {
+		if err := storage.DeleteDigests(chatID, at); err != nil {
+			return errors.Wrap(err, "delete digests")
+		}
+	}
+
+	digestsLck.Lock()
+	defer digestsLck.Unlock()
+	if at == nil {
+		delete(digests, chatID)
+		return nil
+	}
+	list := []Digest{}
+	for _, old := range digests[chatID] {
+		if old.At != *at {
+			list = append(list, old)
+		}
+	}
+	digests[chatID] = list
+	return nil
+}
+
+// dueDigests returns digests that should be sent at nowSlot, both
+// configured using /digest and for groups' notify_chats.
+func dueDigests(nowSlot TimeSlot) []Digest {
+	res := []Digest{}
+	for name, group := range config().Groups {
+		for _, d := range group.Digests {
+			if d.At != nowSlot {
+				continue
+			}
+			for _, chat := range group.NotifyChats {
+				res = append(res, Digest{chat, d.At, digestDays[d.Day], name})
+			}
+		}
+	}
+
+	digestsLck.RLock()
+	defer digestsLck.RUnlock()
+	for _, list := range digests {
+		for _, d := range list {
+			if d.At == nowSlot {
+				res = append(res, d)
+			}
+		}
+	}
+	return res
+}
+
+// sendDigests sends timetables to chats with digest scheduled at now.
+// Days without lessons are skipped.
+func sendDigests(now time.Time) {
+	for _, d := range dueDigests(TimeSlot{now.Hour(), now.Minute()}) {
+		group := d.Group
+		if group == "" {
+			group = chatGroup(d.ChatID)
+		}
+		if group == "" {
+			continue
+		}
+		day := now.AddDate(0, 0, d.DayOffset)
+		entries, retrievedOn, err := cache.OnDayWithAge(group, day)
+		if err != nil {
+			log.Printf("ERROR: While querying entries of %s for %v: %v.\n", group, day, err)
+			continue
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		key := notifyKey(group, "digest:"+day.Format(dayKeyFormat), now)
+		broadcastNotify([]int64{d.ChatID}, key, formatTimetable(day, entries, retrievedOn))
+	}
+}
+
+func formatDigests(list []Digest) string {
+	if len(list) == 0 {
+		return lang().Replies.NoDigests
+	}
+	lines := make([]string, len(list))
+	for i, d := range list {
+		lines[i] = d.At.String() + " - " + digestDayName(d.DayOffset)
+	}
+	return pyfmt.Must(lang().Replies.Digests, map[string]interface{}{
+		"digests": strings.Join(lines, "\n"),
+	})
+}
+
+func digestCmd(msg *tgbotapi.Message, args cmdArgs) error {
+	if !args.has("day") {
+		return reply(msg, formatDigests(chatDigests(msg.Chat.ID)))
+	}
+
+	allowed, err := canConfigureChat(msg)
+	if err != nil {
+		reportError(err, msg)
+		return err
+	}
+	if !allowed {
+		return reply(msg, lang().Replies.MissingPermissions)
+	}
+
+	var at *TimeSlot
+	if args.has("time") {
+		slot, err := parseTimeSlot(args.str("time"))
+		if err != nil {
+			return reply(msg, lang().Usage["digest"])
+		}
+		at = &slot
+	}
+
+	what := strings.ToLower(args.str("day"))
+	if what == "off" {
+		err = removeDigests(msg.Chat.ID, at)
+	} else {
+		offset, prs := digestDays[what]
+		if !prs || at == nil {
+			return reply(msg, lang().Usage["digest"])
+		}
+		err = setDigest(Digest{msg.Chat.ID, *at, offset, ""})
+	}
+	if err != nil {
+		reportError(err, msg)
+		return err
+	}
+	return reply(msg, formatDigests(chatDigests(msg.Chat.ID)))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/slongfield/pyfmt"
+)
+
+type ExamsConfig struct {
+	// LookaheadWeeks is how many weeks ahead /exams looks.
+	LookaheadWeeks int `yaml:"lookahead_weeks"`
+	// CountdownDays lists how many days before exam countdown notifications
+	// are sent. 1 means day-before reminder.
+	CountdownDays []int `yaml:"countdown_days"`
+	// NotifyChats enables exam notifications in groups' notify_chats.
+	NotifyChats bool `yaml:"notify_chats"`
+	// NotifyAt is when exam notifications are sent to notify_chats.
+	// Subscribers get them at their summary time. Required if NotifyChats
+	// is set, nil means it's not specified.
+	NotifyAt *TimeSlot `yaml:"notify_at"`
+}
+
+// IsExam checks whether lesson is part of exam session.
+func (t LessonType) IsExam() bool {
+	return t == Credit || t == Exam
+}
+
+// countdown returns human-readable time left until day.
+func countdown(today, day time.Time) string {
+	days := int(StripTime(day, timezone).Sub(today).Hours()+12) / 24
+	switch days {
+	case 0:
+		return lang().Exams.Today
+	case 1:
+		return lang().Exams.Tomorrow
+	default:
+		return pyfmt.Must(lang().Exams.InDays, map[string]interface{}{"days": days})
+	}
+}
+
+func examArgs(ent Entry, today time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"weekday":   weekdayName(ent.Time),
+		"date":      ent.Time.Format("02.01"),
+		"startTime": ent.Time.Format("15:04"),
+		"name":      ent.Name,
+		"type":      lang().LessonTypes[ent.Type],
+		"classroom": ent.Classroom,
+		"lecturer":  ent.Lecturer,
+		"countdown": countdown(today, ent.Time),
+	}
+}
+
+// examNotifications returns countdown notifications about group's exams
+// that are config.Exams.CountdownDays away from now.
+func examNotifications(now time.Time, group string) []notification {
+	today := StripTime(now, timezone)
+	res := []notification{}
+	for _, days := range config().Exams.CountdownDays {
+		entries, err := cache.OnDay(group, today.AddDate(0, 0, days))
+		if err != nil {
+			continue
+		}
+		for _, ent := range entries {
+			if !ent.Type.IsExam() {
+				continue
+			}
+			tmpl := lang().Exams.Countdown
+			if days == 1 {
+				tmpl = lang().Exams.Reminder
+			}
+			key := notifyKey(group, "exam"+strconv.Itoa(days), ent.Time)
+			res = append(res, notification{key, pyfmt.Must(tmpl, examArgs(ent, today))})
+		}
+	}
+	return res
+}
+
+func examsCmd(msg *tgbotapi.Message, _ cmdArgs) error {
+	group, ok, err := msgGroup(msg)
+	if !ok {
+		return err
+	}
+
+	weeks := config().Exams.LookaheadWeeks
+	if weeks <= 0 {
+		weeks = 8
+	}
+	now := time.Now().In(timezone)
+	entries, err := upcomingEntries(group, now, weeks, func(ent Entry) bool {
+		return ent.Type.IsExam()
+	})
+	if err != nil {
+		reportError(err, msg)
+		return err
+	}
+	if len(entries) == 0 {
+		return reply(msg, lang().Exams.None)
+	}
+
+	today := StripTime(now, timezone)
+	lines := make([]string, len(entries))
+	for i, ent := range entries {
+		lines[i] = pyfmt.Must(lang().Exams.Item, examArgs(ent, today))
+	}
+	return reply(msg, lang().Exams.Header+strings.Join(lines, "\n"))
+}
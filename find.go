@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/slongfield/pyfmt"
+)
+
+// maxFindResults limits length of /find reply.
+const maxFindResults = 20
+
+// normalizeWords splits str into lower-case words without punctuation.
+// Russian ё is replaced with е since it's often omitted.
+func normalizeWords(str string) []string {
+	str = strings.Replace(strings.ToLower(str), "ё", "е", -1)
+	return strings.FieldsFunc(str, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// editDistance returns Levenshtein distance between a and b.
+func editDistance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// wordMatches checks whether query word matches word from entry. Word
+// matches if it contains query or it (or its prefix) differs from query
+// by a few typos.
+func wordMatches(query, word string) bool {
+	if strings.Contains(word, query) {
+		return true
+	}
+	q, w := []rune(query), []rune(word)
+	allowed := 0
+	switch {
+	case len(q) >= 8:
+		allowed = 2
+	case len(q) >= 4:
+		allowed = 1
+	}
+	if allowed == 0 {
+		return false
+	}
+	// Allow query to be incomplete word, e.g. "databse" for "databases",
+	// by comparing it with word prefixes of about the same length.
+	for l := len(q) - allowed; l <= len(q)+allowed && l <= len(w); l++ {
+		if editDistance(q, w[:l]) <= allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// entryMatches checks whether each word of query matches some word of
+// entry's name, lecturer, classroom or type.
+func entryMatches(query []string, ent Entry) bool {
+	words := normalizeWords(strings.Join([]string{
+		ent.Name, ent.Lecturer, ent.Classroom, lang().LessonTypes[ent.Type],
+	}, " "))
+	for _, q := range query {
+		found := false
+		for _, w := range words {
+			if wordMatches(q, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// upcomingEntries returns group's entries starting after now and accepted
+// by filter, looking specified amount of weeks ahead (including current one).
+// At most maxFindResults entries are returned.
+func upcomingEntries(group string, now time.Time, weeks int, filter func(Entry) bool) ([]Entry, error) {
+	today := StripTime(now, timezone)
+	_, last := weekBounds(today.AddDate(0, 0, 7*(weeks-1)))
+
+	res := []Entry{}
+	for day := today; !day.After(last); day = day.AddDate(0, 0, 1) {
+		entries, err := cache.OnDay(group, day)
+		if err != nil {
+			return nil, errors.Wrapf(err, "entries on %s", day.Format("02.01.2006"))
+		}
+		for _, ent := range entries {
+			if ent.Time.Before(now) || !filter(ent) {
+				continue
+			}
+			res = append(res, ent)
+			if len(res) == maxFindResults {
+				return res, nil
+			}
+		}
+	}
+	return res, nil
+}
+
+func findCmd(msg *tgbotapi.Message, args cmdArgs) error {
+	query := normalizeWords(args.str("query"))
+	if len(query) == 0 {
+		return reply(msg, lang().Usage["find"])
+	}
+
+	group, ok, err := msgGroup(msg)
+	if !ok {
+		return err
+	}
+
+	weeks := config().SearchWeeks
+	if weeks <= 0 {
+		weeks = 4
+	}
+	entries, err := upcomingEntries(group, time.Now().In(timezone), weeks, func(ent Entry) bool {
+		return entryMatches(query, ent)
+	})
+	if err != nil {
+		reportError(err, msg)
+		return err
+	}
+	if len(entries) == 0 {
+		return reply(msg, lang().Replies.NothingFound)
+	}
+
+	lines := make([]string, len(entries))
+	for i, ent := range entries {
+		lines[i] = pyfmt.Must(lang().FindResult, map[string]interface{}{
+			"weekday":   weekdayName(ent.Time),
+			"date":      ent.Time.Format("02.01"),
+			"num":       ttindex(TimeSlot{ent.Time.Hour(), ent.Time.Minute()}),
+			"startTime": ent.Time.Format("15:04"),
+			"name":      ent.Name,
+			"type":      lang().LessonTypes[ent.Type],
+			"classroom": ent.Classroom,
+			"lecturer":  ent.Lecturer,
+		})
+	}
+	return reply(msg, lang().Replies.FindHeader+strings.Join(lines, "\n"))
+}
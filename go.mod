@@ -1,12 +1,19 @@
 module github.com/foxcpp/timetable_bot
 
+go 1.27.1
+
 require (
-	github.com/extrame/ole2 v0.0.0-20160812065207-d69429661ad7 // indirect
 	github.com/extrame/xls v0.0.1
 	github.com/go-telegram-bot-api/telegram-bot-api v4.6.2+incompatible
 	github.com/jasonlvhit/gocron v0.0.0-20180312192515-54194c9749d4
+	github.com/mattn/go-sqlite3 v1.9.0
 	github.com/pkg/errors v0.8.0
 	github.com/slongfield/pyfmt v0.0.0-20180124071345-020a7cb18bca
-	github.com/technoweenie/multipartstreamer v1.0.1 // indirect
 	gopkg.in/yaml.v2 v2.2.1
 )
+
+require (
+	github.com/extrame/ole2 v0.0.0-20160812065207-d69429661ad7 // indirect
+	github.com/technoweenie/multipartstreamer v1.0.1 // indirect
+	gopkg.in/check.v1 v0.0.0-20161208181325-20d25e280405 // indirect
+)
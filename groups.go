@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/foxcpp/timetable_bot/ttparser"
+	"github.com/pkg/errors"
+)
+
+// legacyGroup is name of group created from source_cfg and notify_chats of
+// configs written before multi-group support.
+const legacyGroup = "default"
+
+type GroupConfig struct {
+	Source SourceConfig `yaml:"source"`
+	// Where notifications about group's lessons should be sent.
+	NotifyChats []int64 `yaml:"notify_chats"`
+	// Digests sent to NotifyChats.
+	Digests []DigestConfig `yaml:"digests"`
+	// Where today's timetable is posted and pinned at PinAt, and then kept
+	// up to date during the day. PinAt is required if PinChats is set, nil
+	// means it's not specified.
+	PinChats []int64   `yaml:"pin_chats"`
+	PinAt    *TimeSlot `yaml:"pin_at"`
+}
+
+// chatGroups contains groups bound to chats using /setgroup.
+var (
+	chatGroupsLck sync.RWMutex
+	chatGroups    = make(map[int64]string)
+)
+
+func loadChatGroups() error {
+	if storage == nil {
+		return nil
+	}
+	groups, err := storage.LoadChatGroups()
+	if err != nil {
+		return err
+	}
+
+	chatGroupsLck.Lock()
+	defer chatGroupsLck.Unlock()
+	for chat, group := range groups {
+		if _, prs := config().Groups[group]; !prs {
+			// Group was removed from config.
+			continue
+		}
+		chatGroups[chat] = group
+	}
+	return nil
+}
+
+// chatGroup returns group bound to chat, or default group if there is none.
+// Empty string is returned if there is no default group.
+func chatGroup(chatID int64) string {
+	chatGroupsLck.RLock()
+	defer chatGroupsLck.RUnlock()
+
+	if group, prs := chatGroups[chatID]; prs {
+		return group
+	}
+	return config().DefaultGroup
+}
+
+func setChatGroup(chatID int64, group string) error {
+	if storage != nil {
+		if err := storage.SetChatGroup(chatID, group); err != nil {
+			return errors.Wrap(err, "save chat group")
+		}
+	}
+
+	chatGroupsLck.Lock()
+	defer chatGroupsLck.Unlock()
+	chatGroups[chatID] = group
+	return nil
+}
+
+func groupNames() []string {
+	res := make([]string, 0, len(config().Groups))
+	for name := range config().Groups {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// upgradeLegacy converts source_cfg and notify_chats of old configs into
+// group named legacyGroup, so they keep working without changes.
+func (c *Config) upgradeLegacy() error {
+	if c.SourceCfg == nil && len(c.NotifyChats) == 0 {
+		return nil
+	}
+	if len(c.Groups) != 0 {
+		return errors.New("source_cfg and notify_chats can't be used together with groups, move them into group")
+	}
+
+	src := c.SourceCfg
+	if src == nil {
+		src = &ttparser.Cfg{}
+	}
+	params := map[string]interface{}{
+		"group":   src.Group,
+		"faculty": src.Faculty,
+		"course":  src.Course,
+	}
+	if src.URL != "" {
+		params["url"] = src.URL
+	}
+	c.Groups = map[string]GroupConfig{
+		legacyGroup: {
+			Source:      SourceConfig{Type: "dut", Params: params},
+			NotifyChats: c.NotifyChats,
+		},
+	}
+	if c.DefaultGroup == "" {
+		c.DefaultGroup = legacyGroup
+	}
+	c.SourceCfg = nil
+	c.NotifyChats = nil
+
+	log.Println("source_cfg and notify_chats are deprecated, using them as group", legacyGroup, "(see botconf.example.yml)")
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type HTTPConfig struct {
+	// Listen is address of HTTP server, e.g. ":8080". Empty disables server.
+	Listen string `yaml:"listen"`
+	// CalendarWeeks is how many weeks (starting from current one) are
+	// served in calendar feed.
+	CalendarWeeks int `yaml:"calendar_weeks"`
+}
+
+// httpServer is nil if HTTP server is disabled.
+var httpServer *http.Server
+
+func startHTTPServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/calendar/", calendarHandler)
+	mux.HandleFunc("/api/v1/days/", dayHandler)
+
+	httpServer = &http.Server{
+		Addr:         config().HTTP.Listen,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 2 * time.Minute,
+	}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println("ERROR: HTTP server failed:", err)
+		}
+	}()
+}
+
+// calendarHandler serves GET /calendar/{group}.ics.
+func calendarHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/calendar/")
+	if !strings.HasSuffix(name, ".ics") {
+		http.NotFound(w, r)
+		return
+	}
+	group := strings.TrimSuffix(name, ".ics")
+	if _, prs := config().Groups[group]; !prs {
+		http.NotFound(w, r)
+		return
+	}
+
+	weeks := config().HTTP.CalendarWeeks
+	if weeks <= 0 {
+		weeks = 2
+	}
+	from, _ := weekBounds(StripTime(time.Now().In(timezone), timezone))
+	to := from.AddDate(0, 0, 7*weeks-1)
+	if max := from.AddDate(0, 0, maxICSDays); to.After(max) {
+		to = max
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeICS(buf, group, from, to); err != nil {
+		log.Printf("ERROR: Failed to build calendar for %s: %v\n", group, err)
+		http.Error(w, "failed to get timetable", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+type apiEntry struct {
+	Num       int        `json:"num"`
+	Start     time.Time  `json:"start"`
+	End       time.Time  `json:"end"`
+	Type      LessonType `json:"type"`
+	TypeName  string     `json:"type_name"`
+	Classroom string     `json:"classroom"`
+	Lecturer  string     `json:"lecturer"`
+	Name      string     `json:"name"`
+}
+
+type apiDay struct {
+	Group       string     `json:"group"`
+	Date        string     `json:"date"`
+	RetrievedOn time.Time  `json:"retrieved_on"`
+	Outdated    bool       `json:"outdated"`
+	Entries     []apiEntry `json:"entries"`
+}
+
+// inDownloadWindow checks whether day is in range for which timetable can
+// be downloaded on behalf of anonymous clients: from start of current week
+// up to maxICSDays ahead, same as calendar feed.
+func inDownloadWindow(day time.Time) bool {
+	from, _ := weekBounds(StripTime(time.Now().In(timezone), timezone))
+	return !day.Before(from) && !day.After(from.AddDate(0, 0, maxICSDays))
+}
+
+// dayHandler serves GET /api/v1/days/{date}?group={group}, date is in
+// YYYY-MM-DD format. Default group is used if group is not specified.
+// Days outside of inDownloadWindow are served only if cached.
+func dayHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	day, err := time.ParseInLocation(dayKeyFormat, strings.TrimPrefix(r.URL.Path, "/api/v1/days/"), timezone)
+	if err != nil {
+		http.Error(w, "invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	group := r.URL.Query().Get("group")
+	if group == "" {
+		group = config().DefaultGroup
+	}
+	if _, prs := config().Groups[group]; !prs {
+		http.Error(w, "unknown group", http.StatusNotFound)
+		return
+	}
+
+	var (
+		entries     []Entry
+		retrievedOn time.Time
+	)
+	if inDownloadWindow(day) {
+		entries, retrievedOn, err = cache.OnDayWithAge(group, day)
+		if err != nil {
+			log.Printf("ERROR: Failed to get entries of %s for %s: %v\n", group, day.Format(dayKeyFormat), err)
+			http.Error(w, "failed to get timetable", http.StatusBadGateway)
+			return
+		}
+	} else {
+		var prs bool
+		entries, retrievedOn, prs = cache.CachedOnDay(group, day)
+		if !prs {
+			http.Error(w, "date is out of range", http.StatusNotFound)
+			return
+		}
+	}
+
+	res := apiDay{
+		Group:       group,
+		Date:        day.Format(dayKeyFormat),
+		RetrievedOn: retrievedOn,
+		Outdated:    IsOutdated(retrievedOn),
+		Entries:     make([]apiEntry, 0, len(entries)),
+	}
+	conf := config()
+	for _, ent := range entries {
+		num := conf.ttindex(TimeSlot{ent.Time.Hour(), ent.Time.Minute()})
+		if num == -1 {
+			continue
+		}
+		res.Entries = append(res.Entries, apiEntry{
+			Num:       num,
+			Start:     ent.Time,
+			End:       TimeSlotSet(ent.Time, conf.TimeslotsEnd[num-1]),
+			Type:      ent.Type,
+			TypeName:  lang().LessonTypes[ent.Type],
+			Classroom: ent.Classroom,
+			Lecturer:  ent.Lecturer,
+			Name:      ent.Name,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Println("ERROR: Failed to write API response:", err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxICSDays limits length of exported range, each week is a separate
+// download.
+const maxICSDays = 62
+
+const icsTimeFormat = "20060102T150405Z"
+
+var icsEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\n", `\n`,
+)
+
+// icsLine writes content line, folding it to 75 octets as required by RFC 5545.
+func icsLine(b *bytes.Buffer, line string) {
+	// Continuation lines start with space, so they have one octet less.
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		// Don't split UTF-8 sequences.
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+// entryUID returns identifier of lesson. It depends only on group, day,
+// lesson number and index of lesson among parallel ones (sorted by
+// entryLess), so calendar apps update events on reimport instead of
+// creating duplicates. First lesson in slot has no index.
+func entryUID(group string, ent Entry, num, index int) string {
+	uid := fmt.Sprintf("%s-%s-%d", group, ent.Time.Format("20060102"), num)
+	if index != 0 {
+		uid += fmt.Sprintf(".%d", index+1)
+	}
+	return uid + "@timetable_bot"
+}
+
+// writeICS writes iCalendar with group's lessons from first to last day
+// (inclusive).
+func writeICS(w io.Writer, group string, from, to time.Time) error {
+	from = StripTime(from, timezone)
+	to = StripTime(to, timezone)
+	if to.Before(from) {
+		return errors.New("end of range is before start")
+	}
+	if to.Sub(from) > maxICSDays*24*time.Hour {
+		return errors.Errorf("range is longer than %d days", maxICSDays)
+	}
+
+	b := &bytes.Buffer{}
+	icsLine(b, "BEGIN:VCALENDAR")
+	icsLine(b, "VERSION:2.0")
+	icsLine(b, "PRODID:-//foxcpp//timetable_bot//EN")
+	icsLine(b, "CALSCALE:GREGORIAN")
+	icsLine(b, "X-WR-CALNAME:"+icsEscaper.Replace(group))
+
+	conf := config()
+	stamp := time.Now().UTC().Format(icsTimeFormat)
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		entries, err := cache.OnDay(group, day)
+		if err != nil {
+			return errors.Wrapf(err, "entries on %s", day.Format("02.01.2006"))
+		}
+		// Parallel lessons are sorted so their UIDs don't depend on order
+		// of entries in source.
+		slotIndex := make(map[int]int)
+		for _, ent := range sortedEntries(entries) {
+			num := conf.ttindex(TimeSlot{ent.Time.Hour(), ent.Time.Minute()})
+			if num == -1 {
+				continue
+			}
+			index := slotIndex[num]
+			slotIndex[num]++
+			end := TimeSlotSet(ent.Time, conf.TimeslotsEnd[num-1])
+
+			desc := lang().LessonTypes[ent.Type]
+			if ent.Lecturer != "" {
+				desc += "\n" + ent.Lecturer
+			}
+
+			icsLine(b, "BEGIN:VEVENT")
+			icsLine(b, "UID:"+entryUID(group, ent, num, index))
+			icsLine(b, "DTSTAMP:"+stamp)
+			icsLine(b, "DTSTART:"+ent.Time.UTC().Format(icsTimeFormat))
+			icsLine(b, "DTEND:"+end.UTC().Format(icsTimeFormat))
+			icsLine(b, "SUMMARY:"+icsEscaper.Replace(ent.Name))
+			if ent.Classroom != "" {
+				icsLine(b, "LOCATION:"+icsEscaper.Replace(ent.Classroom))
+			}
+			icsLine(b, "DESCRIPTION:"+icsEscaper.Replace(desc))
+			icsLine(b, "END:VEVENT")
+		}
+	}
+	icsLine(b, "END:VCALENDAR")
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
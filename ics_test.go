@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/timetable_bot/ttparser"
+)
+
+// staticSource returns same entries for each day.
+type staticSource []ttparser.RawEntry
+
+func (s staticSource) Fetch(from, to time.Time) (map[time.Time][]ttparser.RawEntry, error) {
+	res := make(map[time.Time][]ttparser.RawEntry)
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		res[StripTime(day, time.UTC)] = s
+	}
+	return res, nil
+}
+
+func TestWriteICSParallelLessons(t *testing.T) {
+	timezone = time.UTC
+	currentConfig.Store(&Config{
+		TimeslotsBegin: []TimeSlot{{8, 0}, {9, 50}},
+		TimeslotsEnd:   []TimeSlot{{9, 35}, {11, 25}},
+	})
+	currentLang.Store(&LangStrings{})
+
+	var err error
+	cache, err = NewCache(map[string]ttparser.Source{"g": staticSource{
+		{Sequence: 2, Name: "Physics", Lecturer: "Ivanov"},
+		{Sequence: 1, Name: "Math"},
+		{Sequence: 2, Name: "Chemistry", Lecturer: "Sidorov"},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	day := time.Date(2018, 9, 12, 0, 0, 0, 0, time.UTC)
+	b := &bytes.Buffer{}
+	if err := writeICS(b, "g", day, day); err != nil {
+		t.Fatal(err)
+	}
+
+	uids := []string{}
+	for _, line := range strings.Split(b.String(), "\r\n") {
+		if strings.HasPrefix(line, "UID:") {
+			uids = append(uids, strings.TrimPrefix(line, "UID:"))
+		}
+	}
+	want := []string{
+		"g-20180912-1@timetable_bot",
+		"g-20180912-2@timetable_bot",
+		"g-20180912-2.2@timetable_bot",
+	}
+	if strings.Join(uids, " ") != strings.Join(want, " ") {
+		t.Errorf("got UIDs %v, want %v", uids, want)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/slongfield/pyfmt"
+)
+
+// inlineCacheSecs is how long Telegram may cache inline query results.
+const inlineCacheSecs = 60
+
+// inlineResult returns inline query result with group's timetable for day.
+// Inline queries are sent on every keystroke, so only cached timetable is
+// used. If day is not cached, its download is started in background and
+// false is returned.
+func inlineResult(group string, day time.Time) (tgbotapi.InlineQueryResultArticle, bool) {
+	entries, retrievedOn, prs := cache.CachedOnDay(group, day)
+	if !prs {
+		cache.refreshInBackground(dayKey{group, StripTime(day, day.Location())})
+		return tgbotapi.InlineQueryResultArticle{}, false
+	}
+
+	title := pyfmt.Must(lang().Inline.Title, map[string]interface{}{
+		"weekday": weekdayName(day),
+		"date":    day.Format("02.01"),
+		"group":   group,
+	})
+	res := tgbotapi.NewInlineQueryResultArticleMarkdown(
+		group+":"+day.Format(dayKeyFormat), title, formatTimetable(day, entries, retrievedOn))
+
+	names := make([]string, len(entries))
+	for i, ent := range entries {
+		names[i] = strconv.Itoa(ttindex(TimeSlot{ent.Time.Hour(), ent.Time.Minute()})) + ". " + ent.Name
+	}
+	res.Description = strings.Join(names, ", ")
+	if len(entries) == 0 {
+		res.Description = lang().Inline.NoLessons
+	}
+	return res, true
+}
+
+// handleInlineQuery answers "@bot DATE" queries with timetable. Query can
+// start with group name, otherwise group of user's private chat is used.
+// Empty query returns today's and tomorrow's timetables. Days outside of
+// inDownloadWindow or not cached yet are not returned.
+func handleInlineQuery(query *tgbotapi.InlineQuery) error {
+	group := chatGroup(int64(query.From.ID))
+	text := strings.TrimSpace(query.Query)
+	if words := strings.Fields(text); len(words) != 0 {
+		if _, prs := config().Groups[words[0]]; prs {
+			group = words[0]
+			text = strings.TrimSpace(strings.TrimPrefix(text, words[0]))
+		}
+	}
+
+	answer := tgbotapi.InlineConfig{
+		InlineQueryID: query.ID,
+		Results:       []interface{}{},
+		CacheTime:     inlineCacheSecs,
+		// Results depend on user's group.
+		IsPersonal: true,
+	}
+
+	if group != "" {
+		today := StripTime(time.Now().In(timezone), timezone)
+		days := []time.Time{today, today.AddDate(0, 0, 1)}
+		if text != "" {
+			day, err := parseDate(text, time.Now())
+			if err != nil {
+				// User is probably still typing.
+				days = nil
+			} else {
+				days = []time.Time{day}
+			}
+		}
+
+		for _, day := range days {
+			if !inDownloadWindow(day) {
+				continue
+			}
+			res, ok := inlineResult(group, day)
+			if !ok {
+				// Don't let Telegram cache incomplete answer, timetable
+				// will be there on next query.
+				answer.CacheTime = 0
+				continue
+			}
+			answer.Results = append(answer.Results, res)
+		}
+	} else {
+		answer.SwitchPMText = lang().Inline.SetGroup
+		answer.SwitchPMParameter = "setgroup"
+	}
+
+	if _, err := bot.AnswerInlineQuery(answer); err != nil {
+		return errors.Wrapf(err, "answerInlineQuery %v", query.ID)
+	}
+	return nil
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
-	"io/ioutil"
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"math/rand"
 	"os"
-	"os/exec"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -21,8 +24,7 @@ import (
 
 var bot *tgbotapi.BotAPI
 var cache *Cache
-var config Config
-var lang LangStrings
+var storage *Storage
 
 type TimeSlot struct {
 	Hour, Minute int
@@ -31,29 +33,58 @@ type TimeSlot struct {
 func (ts *TimeSlot) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	str := ""
 	if err := unmarshal(&str); err != nil {
-
+		return err
+	}
+	slot, err := parseTimeSlot(str)
+	if err != nil {
+		// TypeError makes decoder continue so all invalid values are
+		// reported at once.
+		return &yaml.TypeError{Errors: []string{str + ": " + err.Error()}}
 	}
+	*ts = slot
+	return nil
+}
+
+// parseTimeSlot parses time of day in HH:MM format.
+func parseTimeSlot(str string) (TimeSlot, error) {
+	ts := TimeSlot{}
 	splitten := strings.Split(str, ":")
 	if len(splitten) != 2 {
-		return errors.New("invalid timeslot format")
+		return ts, errors.New("invalid timeslot format")
 	}
 	hourStr := splitten[0]
 	minuteStr := splitten[1]
 	if hour, err := strconv.Atoi(hourStr); err != nil {
-		return errors.Wrap(err, "invalid hour value")
+		return ts, errors.Wrap(err, "invalid hour value")
 	} else {
 		ts.Hour = hour
 	}
 	if minute, err := strconv.Atoi(minuteStr); err != nil {
-		return errors.Wrap(err, "invalid minute value")
+		return ts, errors.Wrap(err, "invalid minute value")
 	} else {
 		ts.Minute = minute
 	}
-	return nil
+	if ts.Hour < 0 || ts.Hour > 23 {
+		return ts, errors.Errorf("hour out of range: %d", ts.Hour)
+	}
+	if ts.Minute < 0 || ts.Minute > 59 {
+		return ts, errors.Errorf("minute out of range: %d", ts.Minute)
+	}
+	return ts, nil
+}
+
+func (ts TimeSlot) String() string {
+	return fmt.Sprintf("%02d:%02d", ts.Hour, ts.Minute)
 }
 
 func ttindex(slot TimeSlot) int {
-	for i, slotI := range config.TimeslotsBegin {
+	return config().ttindex(slot)
+}
+
+// ttindex returns number of lesson starting at slot or -1. Use it instead of
+// global ttindex if other timeslots of same config are used too.
+func (c *Config) ttindex(slot TimeSlot) int {
+	for i, slotI := range c.TimeslotsBegin {
 		if slotI == slot {
 			return i + 1
 		}
@@ -69,19 +100,48 @@ type Config struct {
 	CmdProcGoroutines int    `yaml:"cmd_processing_goroutines"`
 
 	Admins []int `yaml:"admins"`
+	// ReportPanics sends details of crashes while processing updates to
+	// admins.
+	ReportPanics bool `yaml:"report_panics"`
+
+	Prefetch PrefetchConfig `yaml:"prefetch"`
+	HTTP     HTTPConfig     `yaml:"http"`
+	Webhook  WebhookConfig  `yaml:"webhook"`
+
+	// ShutdownTimeoutSecs is how long to wait for running commands and
+	// jobs on shutdown.
+	ShutdownTimeoutSecs int `yaml:"shutdown_timeout_secs"`
+
+	// SearchWeeks is how many weeks ahead /find looks.
+	SearchWeeks int `yaml:"search_weeks"`
+
+	Exams ExamsConfig `yaml:"exams"`
 
-	NotifyChats   []int64 `yaml:"notify_chats"`
-	NotifyInMins  int     `yaml:"notify_in_mins"`
-	NotifyOnEnd   bool    `yaml:"notify_on_end"`
-	NotifyOnBreak bool    `yaml:"notify_on_break"`
+	NotifyInMins  int  `yaml:"notify_in_mins"`
+	NotifyOnEnd   bool `yaml:"notify_on_end"`
+	NotifyOnBreak bool `yaml:"notify_on_break"`
 
 	TimeZone       string     `yaml:"timezone"`
 	TimeslotsBegin []TimeSlot `yaml:"timeslots_begin"`
 	TimeslotsBreak []TimeSlot `yaml:"timeslots_break"`
 	TimeslotsEnd   []TimeSlot `yaml:"timeslots_end"`
 
-	SourceCfg    ttparser.Cfg `yaml:"source_cfg"`
-	GroupMembers []string     `yaml:"group_members"`
+	// DefaultGroup is used in chats without group set using /setgroup.
+	DefaultGroup string                 `yaml:"default_group"`
+	Groups       map[string]GroupConfig `yaml:"groups"`
+	GroupMembers []string               `yaml:"group_members"`
+
+	// SourceCfg and NotifyChats are settings used before multi-group
+	// support, see upgradeLegacy.
+	SourceCfg   *ttparser.Cfg `yaml:"source_cfg"`
+	NotifyChats []int64       `yaml:"notify_chats"`
+}
+
+// SourceConfig selects timetable source implementation (see ttparser.Register).
+// All keys except type are passed to source as is.
+type SourceConfig struct {
+	Type   string                 `yaml:"type"`
+	Params map[string]interface{} `yaml:",inline"`
 }
 
 type LangStrings struct {
@@ -89,10 +149,14 @@ type LangStrings struct {
 	LessonTypeStrs map[string]LessonType `yaml:"lesson_types_short"`
 	Help           string                `yaml:"help"`
 	AdminHelp      string                `yaml:"adminhelp"`
-	Usage          struct {
-		Schedule string `yaml:"schedule"`
-		Evict    string `yaml:"evict"`
-	} `yaml:"usage"`
+	// Commands contains descriptions of commands, keyed by command name.
+	Commands map[string]string `yaml:"commands"`
+	// ArgNames contains names of command arguments shown in help.
+	ArgNames          map[string]string `yaml:"args"`
+	CommandHelpFormat string            `yaml:"command_help_format"`
+	// Usage contains usage help of commands, keyed by command name.
+	// {groups} and {current} are replaced with available and chat's groups.
+	Usage   map[string]string `yaml:"usage"`
 	Replies struct {
 		SomethingBroke     string `yaml:"something_broke"`
 		MissingPermissions string `yaml:"missing_permissions"`
@@ -100,11 +164,65 @@ type LangStrings struct {
 		TimetableHeader    string `yaml:"timetable_header"`
 		Empty              string `yaml:"empty"`
 		NoMoreLessonsToday string `yaml:"no_more_lessons_today"`
+		InvalidLessonNum   string `yaml:"invalid_lesson_num"`
+		InvalidLessonType  string `yaml:"invalid_lesson_type"`
+		NoSuchLesson       string `yaml:"no_such_lesson"`
+		NoGroup            string `yaml:"no_group"`
+		UnknownGroup       string `yaml:"unknown_group"`
+		PrivateOnly        string `yaml:"private_only"`
+		Subscribed         string `yaml:"subscribed"`
+		Unsubscribed       string `yaml:"unsubscribed"`
+		NotSubscribed      string `yaml:"not_subscribed"`
+		Outdated           string `yaml:"outdated"`
+		CacheStats         string `yaml:"cache_stats"`
+		InvalidRange       string `yaml:"invalid_range"`
+		WeekHeader         string `yaml:"week_header"`
+		FindHeader         string `yaml:"find_header"`
+		NothingFound       string `yaml:"nothing_found"`
+		Digests            string `yaml:"digests"`
+		NoDigests          string `yaml:"no_digests"`
+		Reloaded           string `yaml:"reloaded"`
+		Usage              string `yaml:"usage"`
+		ReloadFailed       string `yaml:"reload_failed"`
 	} `yaml:"replies"`
-	EntryTemplate   string `yaml:"entry_template"`
-	LessonEndNotify string `yaml:"lesson_end_notify"`
-	BreakNotify     string `yaml:"break_notify"`
-	TimeslotFormat  string `yaml:"timeslot_format"`
+	EntryTemplate string `yaml:"entry_template"`
+	// ExamEntryTemplate is used instead of EntryTemplate for credits and exams.
+	ExamEntryTemplate string `yaml:"exam_entry_template"`
+	LessonEndNotify   string `yaml:"lesson_end_notify"`
+	BreakNotify       string `yaml:"break_notify"`
+	TimeslotFormat    string `yaml:"timeslot_format"`
+	NotifySettings    string `yaml:"notify_settings"`
+	// WeekDayHeader and WeekEntryTemplate are used in compact week view.
+	WeekDayHeader     string `yaml:"week_day_header"`
+	WeekEntryTemplate string `yaml:"week_entry_template"`
+	FindResult        string `yaml:"find_result"`
+	// Weekdays contains names of week days, starting from Sunday.
+	Weekdays      []string `yaml:"weekdays"`
+	WeekdaysShort []string `yaml:"weekdays_short"`
+	Changes       struct {
+		Header    string `yaml:"header"`
+		Added     string `yaml:"added"`
+		Removed   string `yaml:"removed"`
+		Name      string `yaml:"name"`
+		Type      string `yaml:"type"`
+		Classroom string `yaml:"classroom"`
+		Lecturer  string `yaml:"lecturer"`
+	} `yaml:"changes"`
+	Inline struct {
+		Title     string `yaml:"title"`
+		NoLessons string `yaml:"no_lessons"`
+		SetGroup  string `yaml:"set_group"`
+	} `yaml:"inline"`
+	Exams struct {
+		Header    string `yaml:"header"`
+		None      string `yaml:"none"`
+		Item      string `yaml:"item"`
+		Countdown string `yaml:"countdown"`
+		Reminder  string `yaml:"reminder"`
+		Today     string `yaml:"today"`
+		Tomorrow  string `yaml:"tomorrow"`
+		InDays    string `yaml:"in_days"`
+	} `yaml:"exams"`
 }
 
 func extractCommand(msg *tgbotapi.Message) string {
@@ -131,69 +249,119 @@ func extractCommand(msg *tgbotapi.Message) string {
 }
 
 func formatEntry(entry Entry) string {
-	ttindx := ttindex(TimeSlot{entry.Time.Hour(), entry.Time.Minute()})
+	conf := config()
+	strs := lang()
+	ttindx := conf.ttindex(TimeSlot{entry.Time.Hour(), entry.Time.Minute()})
+	// Entry stored before timeslots were changed may match none of them.
+	endTime := "?"
+	if ttindx != -1 {
+		endTime = TimeSlotSet(time.Now(), conf.TimeslotsEnd[ttindx-1]).Format("15:04")
+	}
 
-	return pyfmt.Must(lang.EntryTemplate, map[string]interface{}{
+	tmpl := strs.EntryTemplate
+	if entry.Type.IsExam() {
+		tmpl = strs.ExamEntryTemplate
+	}
+	return pyfmt.Must(tmpl, map[string]interface{}{
 		"num":       ttindx,
 		"classroom": entry.Classroom,
 		"name":      entry.Name,
 		"startTime": entry.Time.Format("15:04"),
-		"endTime":   TimeSlotSet(time.Now(), config.TimeslotsEnd[ttindx-1]).Format("15:04"),
-		"type":      lang.LessonTypes[entry.Type],
+		"endTime":   endTime,
+		"type":      strs.LessonTypes[entry.Type],
 		"lecturer":  entry.Lecturer,
 	})
 }
 
-func processUpdates(updates <-chan tgbotapi.Update) {
+// processUpdates handles updates until ctx is cancelled. Update being
+// handled at that moment is processed to the end.
+func processUpdates(ctx context.Context, updates <-chan tgbotapi.Update, wg *sync.WaitGroup) {
+	defer wg.Done()
 	for {
-		update := <-updates
-		if update.CallbackQuery != nil {
-			err := handleCallbackQuery(update.CallbackQuery)
+		var update tgbotapi.Update
+		select {
+		case update = <-updates:
+		case <-ctx.Done():
+			return
+		}
+		handleUpdateSafely(update)
+	}
+}
 
+// pollUpdates receives updates using long polling until ctx is cancelled.
+// It's used instead of GetUpdatesChan because that can't be stopped.
+// Updates received after ctx is cancelled are dropped, Telegram sends
+// them again on next start because their offset is not confirmed.
+func pollUpdates(ctx context.Context, conf tgbotapi.UpdateConfig) tgbotapi.UpdatesChannel {
+	ch := make(chan tgbotapi.Update, bot.Buffer)
+	go func() {
+		for ctx.Err() == nil {
+			updates, err := bot.GetUpdates(conf)
 			if err != nil {
-				log.Printf("ERROR: while processing callback query id %v: %v\n",
-					update.CallbackQuery.ID, err)
-			}
-		} else {
-			if update.Message == nil || update.Message.Text == "" {
+				log.Println("ERROR: Failed to get updates, retrying in 3 seconds:", err)
+				select {
+				case <-time.After(3 * time.Second):
+				case <-ctx.Done():
+				}
 				continue
 			}
-			msg := update.Message
 
-			if msg.Text == "<3" && msg.ReplyToMessage != nil && msg.ReplyToMessage.From.ID == bot.Self.ID {
-				easterEgg(msg)
-				continue
+			for _, update := range updates {
+				if update.UpdateID < conf.Offset {
+					continue
+				}
+				conf.Offset = update.UpdateID + 1
+				select {
+				case ch <- update:
+				case <-ctx.Done():
+					return
+				}
 			}
+		}
+	}()
+	return ch
+}
 
-			command := extractCommand(msg)
-			if command == "" {
-				continue
-			}
+func handleUpdate(update tgbotapi.Update) {
+	if update.CallbackQuery != nil {
+		err := handleCallbackQuery(update.CallbackQuery)
 
-			var err error
-			switch command {
-			case "today":
-				err = todayCmd(msg)
-			case "tomorrow":
-				err = tomorrowCmd(msg)
-			case "next":
-				err = nextCmd(msg)
-			case "timetable":
-				err = timetableCmd(msg)
-			case "help":
-				err = helpCmd(msg)
-			case "adminhelp":
-				err = adminHelpCmd(msg)
-			case "schedule":
-				err = scheduleCmd(msg)
-			case "evict":
-				err = evictCmd(msg)
-			}
+		if err != nil {
+			log.Printf("ERROR: while processing callback query id %v: %v\n",
+				update.CallbackQuery.ID, err)
+		}
+	} else if update.InlineQuery != nil {
+		err := handleInlineQuery(update.InlineQuery)
 
-			if err != nil {
-				log.Printf("ERROR: while processing command %s in chatid=%d,msgid=%d,uid=%d: %v\n",
-					command, msg.Chat.ID, msg.MessageID, msg.From.ID, err)
-			}
+		if err != nil {
+			log.Printf("ERROR: while processing inline query id %v: %v\n",
+				update.InlineQuery.ID, err)
+		}
+	} else {
+		if update.Message == nil || update.Message.Text == "" {
+			return
+		}
+		msg := update.Message
+
+		if msg.Text == "<3" && msg.ReplyToMessage != nil && msg.ReplyToMessage.From.ID == bot.Self.ID {
+			easterEgg(msg)
+			return
+		}
+
+		command := extractCommand(msg)
+		if command == "" {
+			return
+		}
+
+		cmd, prs := commandsByName[command]
+		if !prs {
+			return
+		}
+
+		err := dispatchCommand(cmd, msg)
+		if err != nil {
+			log.Printf("ERROR: while processing command %s in chatid=%d,msgid=%d,uid=%d: %v\n",
+				command, msg.Chat.ID, msg.MessageID, msg.From.ID, err)
 		}
 	}
 }
@@ -204,75 +372,166 @@ func main() {
 		log.SetFlags(0)
 	}
 
-	if len(os.Args) != 2 {
-		log.Fatalln("Usage:", os.Args[0], "<config file>")
+	checkConfig := flag.Bool("check-config", false, "Check config and lang files and exit")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatalln("Usage:", os.Args[0], "[--check-config] <config file>")
 	}
-	configPath := os.Args[1]
+	configPath = flag.Arg(0)
 
-	confFile, err := ioutil.ReadFile(configPath)
-	if err != nil {
-		log.Fatalln("Failed to read config file (botconf.yml):", err)
-	}
-	if err = yaml.UnmarshalStrict(confFile, &config); err != nil {
-		log.Fatalln("Failed to decode config file (botconf.yml):", err)
+	conf, strs, err := loadConfig(configPath)
+	if problems, ok := err.(ValidationError); ok {
+		log.Println("Configuration is invalid:")
+		for _, problem := range problems {
+			log.Println("-", problem)
+		}
+		os.Exit(1)
 	}
-
-	langFile, err := ioutil.ReadFile(config.Lang)
 	if err != nil {
-		log.Fatalln("Failed read lang file:", err)
+		log.Fatalln("Failed to load configuration:", err)
 	}
-	if err = yaml.UnmarshalStrict(langFile, &lang); err != nil {
-		log.Fatalln("Failed to decode lang file:", err)
+	if *checkConfig {
+		log.Println("Configuration is OK.")
+		return
 	}
+	currentConfig.Store(conf)
+	currentLang.Store(strs)
 
-	timezone, err = time.LoadLocation(config.TimeZone)
+	timezone, err = time.LoadLocation(config().TimeZone)
 	if err != nil {
 		log.Fatalln("Failed to set timezone:", err)
 	}
 
 	log.Println("Configuration:")
-	log.Println("- Lang file:", config.Lang)
-	log.Println("- Token:", config.Token[:10]+"...")
+	log.Println("- Lang file:", config().Lang)
+	log.Println("- Storage:", config().Driver, config().DSN)
+	// Only bot ID part of token is logged, the rest is secret.
+	log.Println("- Bot ID:", strings.SplitN(config().Token, ":", 2)[0])
 	log.Println("- Timezone:", timezone)
-	log.Println("- Admins:", config.Admins)
-	log.Println("- Notify targets:", config.NotifyChats)
-	log.Printf("- Source: %+v\n", config.SourceCfg)
-	log.Println("- Group members:", len(config.GroupMembers), "people")
-	log.Println("- Notify: in", config.NotifyInMins, "before begin; on end:", config.NotifyOnEnd, "; on break:", config.NotifyOnBreak)
-
-	cache = NewCache()
-	bot, err = tgbotapi.NewBotAPI(config.Token)
+	log.Println("- Admins:", config().Admins)
+	log.Println("- Default group:", config().DefaultGroup)
+	for _, name := range groupNames() {
+		group := config().Groups[name]
+		log.Printf("- Group %s: source %s %v, notify targets: %v\n", name, group.Source.Type, group.Source.Params, group.NotifyChats)
+	}
+	log.Println("- Group members:", len(config().GroupMembers), "people")
+	log.Println("- Prefetch: every", config().Prefetch.IntervalMins, "mins; jitter:", config().Prefetch.JitterSecs, "secs; max backoff:", config().Prefetch.MaxBackoffMins, "mins")
+	log.Println("- HTTP server:", config().HTTP.Listen)
+	if config().Webhook.Listen != "" {
+		log.Println("- Updates: webhook on", config().Webhook.Listen, "for", config().Webhook.URL)
+	} else {
+		log.Println("- Updates: long polling")
+	}
+	log.Println("- Notify: in", config().NotifyInMins, "before begin; on end:", config().NotifyOnEnd, "; on break:", config().NotifyOnBreak)
+
+	sources := make(map[string]ttparser.Source)
+	for name, group := range config().Groups {
+		sources[name], err = ttparser.NewSource(group.Source.Type, group.Source.Params)
+		if err != nil {
+			log.Fatalln("Failed to init timetable source for group", name+":", err)
+		}
+	}
+
+	if config().Driver != "" {
+		storage, err = OpenStorage(config().Driver, config().DSN)
+		if err != nil {
+			log.Fatalln("Failed to open storage:", err)
+		}
+	}
+
+	if err := loadChatGroups(); err != nil {
+		log.Fatalln("Failed to load chat groups:", err)
+	}
+	if err := loadSubscriptions(); err != nil {
+		log.Fatalln("Failed to load subscriptions:", err)
+	}
+	if err := loadDigests(); err != nil {
+		log.Fatalln("Failed to load digests:", err)
+	}
+	if err := loadPinned(); err != nil {
+		log.Fatalln("Failed to load pinned messages:", err)
+	}
+
+	cache, err = NewCache(sources, storage)
+	if err != nil {
+		log.Fatalln("Failed to init cache:", err)
+	}
+	cache.OnChange = func(group string, changes []DayChange) {
+		markPinnedChanges(group, changes)
+		notifyChanges(group, changes)
+	}
+	bot, err = tgbotapi.NewBotAPI(config().Token)
 	if err != nil {
 		log.Fatalln("Failed to init Bot API:", err)
 	}
 
-	gocron.Every(1).Minute().Do(checkNotifications)
-	gocron.Start()
+	if err := setBotCommands(); err != nil {
+		log.Println("Failed to set bot commands list:", err)
+	}
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 25
-	updates, err := bot.GetUpdatesChan(u)
-	if err != nil {
-		log.Fatalln("Failed to init. updates channel:", err)
+	ctx, stopWorkers := context.WithCancel(context.Background())
+
+	gocron.Every(1).Minute().Do(tracked("checking notifications", func() { checkNotifications(ctx) }))
+	gocron.Every(1).Minute().Do(tracked("updating pinned messages", func() { updatePinned(ctx) }))
+	gocron.Every(1).Hour().Do(tracked("pruning sent notifications", pruneNotified))
+	gocron.Every(1).Hour().Do(tracked("pruning stored timetables", pruneStored))
+	schedulers := []chan bool{gocron.Start()}
+
+	if config().Prefetch.IntervalMins != 0 {
+		rand.Seed(time.Now().UnixNano())
+
+		// Separate scheduler is used so slow downloads will not delay notifications.
+		prefetchScheduler := gocron.NewScheduler()
+		prefetchScheduler.Every(uint64(config().Prefetch.IntervalMins)).Minutes().Do(tracked("prefetching timetables", func() { prefetch(ctx) }))
+		schedulers = append(schedulers, prefetchScheduler.Start())
+		go tracked("prefetching timetables", func() { prefetch(ctx) })()
 	}
 
-	sig := make(chan os.Signal)
+	if config().HTTP.Listen != "" {
+		startHTTPServer()
+	}
+
+	var updates tgbotapi.UpdatesChannel
+	// stopPolling is no-op in webhook mode, webhook server is stopped by
+	// shutdown.
+	pollCtx, stopPolling := context.WithCancel(context.Background())
+	if config().Webhook.Listen != "" {
+		updates, err = startWebhook()
+		if err != nil {
+			log.Fatalln("Failed to init. updates channel:", err)
+		}
+	} else {
+		// Webhook set during previous run prevents getUpdates from working.
+		if _, err := bot.RemoveWebhook(); err != nil {
+			log.Println("Failed to remove webhook:", err)
+		}
+		u := tgbotapi.NewUpdate(0)
+		u.Timeout = 25
+		updates = pollUpdates(pollCtx, u)
+	}
+
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGTERM, syscall.SIGHUP, os.Interrupt)
 
 	log.Println("Started.")
 
-	if os.Getenv("USING_SYSTEMD") == "1" {
-		cmd := exec.Command("systemd-notify", "--ready", `--status=Listening for updates`)
-		if out, err := cmd.Output(); err != nil {
-			log.Println("Failed to notify systemd about successful startup:", err)
-			log.Println(string(out))
-		}
-	}
+	systemdNotify("--ready", "--status=Listening for updates")
 
-	for i := 0; i < config.CmdProcGoroutines; i++ {
-		go processUpdates(updates)
+	workers := &sync.WaitGroup{}
+	for i := 0; i < config().CmdProcGoroutines; i++ {
+		workers.Add(1)
+		go processUpdates(ctx, updates, workers)
 	}
 
-	s := <-sig
-	log.Printf("%v; stopping...\n", s)
+	for s := range sig {
+		if s != syscall.SIGHUP {
+			log.Printf("%v; stopping...\n", s)
+			break
+		}
+		if err := reloadConfig(); err != nil {
+			log.Println("ERROR: Failed to reload configuration:", err)
+		}
+	}
+	shutdown(stopPolling, updates, stopWorkers, workers, schedulers...)
+	log.Println("Stopped.")
 }
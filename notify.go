@@ -1,53 +1,141 @@
 package main
 
 import (
+	"context"
 	"github.com/go-telegram-bot-api/telegram-bot-api"
 	"log"
 	"time"
 )
 
-func checkNotifications() {
+// firstLessonNotifyMins is how long before first lesson of day EventFirst
+// notification is sent.
+const firstLessonNotifyMins = 25
+
+type notifyPrefs struct {
+	leadMins  int
+	events    NotifyEvent
+	summaryAt TimeSlot
+	examsAt   TimeSlot
+}
+
+type notification struct {
+	key, text string
+}
+
+func checkNotifications(ctx context.Context) {
 	now := time.Now().In(timezone)
 
-	if config.NotifyOnEnd {
-		for _, slot := range config.TimeslotsEnd {
-			if slot == (TimeSlot{now.Hour(), now.Minute()}) {
-				broadcastNotify(lang.LessonEndNotify)
+	chatPrefs := notifyPrefs{leadMins: config().NotifyInMins, events: EventStart | EventFirst}
+	if config().NotifyOnEnd {
+		chatPrefs.events |= EventEnd
+	}
+	if config().NotifyOnBreak {
+		chatPrefs.events |= EventBreak
+	}
+	if config().Exams.NotifyChats && config().Exams.NotifyAt != nil {
+		chatPrefs.events |= EventExams
+		chatPrefs.examsAt = *config().Exams.NotifyAt
+	}
+	for name, group := range config().Groups {
+		if ctx.Err() != nil {
+			return
+		}
+		for _, n := range pendingNotifications(now, name, chatPrefs) {
+			broadcastNotify(group.NotifyChats, n.key, n.text)
+		}
+	}
+
+	sendDigests(now)
+
+	for _, sub := range allSubscriptions() {
+		if ctx.Err() != nil {
+			return
+		}
+		if sub.isQuiet(now) {
+			continue
+		}
+		group := chatGroup(sub.ChatID)
+		if group == "" {
+			continue
+		}
+		for _, n := range pendingNotifications(now, group, sub.prefs()) {
+			broadcastNotify([]int64{sub.ChatID}, n.key, n.text)
+		}
+	}
+}
+
+// pendingNotifications returns notifications for group that should be sent
+// at specified time according to prefs.
+func pendingNotifications(now time.Time, group string, prefs notifyPrefs) []notification {
+	res := []notification{}
+	nowSlot := TimeSlot{now.Hour(), now.Minute()}
+
+	if prefs.events&EventEnd != 0 {
+		for _, slot := range config().TimeslotsEnd {
+			if slot == nowSlot {
+				res = append(res, notification{notifyKey(group, "end", now), lang().LessonEndNotify})
 			}
 		}
 	}
-	if config.NotifyOnBreak {
-		for _, slot := range config.TimeslotsEnd {
-			if slot == (TimeSlot{now.Hour(), now.Minute()}) {
-				broadcastNotify(lang.BreakNotify)
+	if prefs.events&EventBreak != 0 {
+		for _, slot := range config().TimeslotsBreak {
+			if slot == nowSlot {
+				res = append(res, notification{notifyKey(group, "break", now), lang().BreakNotify})
 			}
 		}
 	}
 
-	entries, err := cache.OnDay(now)
-	if err != nil {
-		log.Printf("ERROR: While querying entries for %v: %v.\n", now, err)
-		return
+	if prefs.events&EventExams != 0 && prefs.examsAt == nowSlot {
+		res = append(res, examNotifications(now, group)...)
 	}
-	if len(entries) != 0 &&
-		now.Add(time.Minute*25).Hour() == entries[0].Time.Hour() &&
-		now.Add(time.Minute*25).Minute() == entries[0].Time.Minute() {
 
-		broadcastNotify(formatEntry(entries[0]))
+	entries, retrievedOn, err := cache.OnDayWithAge(group, now)
+	if err != nil {
+		log.Printf("ERROR: While querying entries of %s for %v: %v.\n", group, now, err)
+		return res
+	}
+	if prefs.events&EventSummary != 0 && prefs.summaryAt == nowSlot && len(entries) != 0 {
+		res = append(res, notification{notifyKey(group, "summary", now), formatTimetable(now, entries, retrievedOn)})
 	}
+	firstAt := now.Add(time.Minute * firstLessonNotifyMins)
+	if prefs.events&EventFirst != 0 && len(entries) != 0 &&
+		firstAt.Hour() == entries[0].Time.Hour() &&
+		firstAt.Minute() == entries[0].Time.Minute() {
 
-	entry, err := cache.ExactGet(now.Add(time.Minute * time.Duration(config.NotifyInMins)))
-	if err != nil {
-		log.Printf("ERROR: While querying entry for %v: %v.\n", now.Add(time.Minute*time.Duration(config.NotifyInMins)), err)
-		return
+		res = append(res, notification{notifyKey(group, "first", entries[0].Time), formatEntry(entries[0])})
 	}
-	if entry != nil {
-		broadcastNotify(formatEntry(*entry))
+
+	if prefs.events&EventStart != 0 {
+		startAt := now.Add(time.Minute * time.Duration(prefs.leadMins))
+		entry, err := cache.ExactGet(group, startAt)
+		if err != nil {
+			log.Printf("ERROR: While querying entry of %s for %v: %v.\n", group, startAt, err)
+			return res
+		}
+		if entry != nil {
+			res = append(res, notification{notifyKey(group, "start", entry.Time), formatEntry(*entry)})
+		}
 	}
+	return res
 }
 
-func broadcastNotify(notifyStr string) {
-	for _, chat := range config.NotifyChats {
+// notifyKey identifies notification about event at specified time so
+// it will not be sent twice (e.g. if bot was restarted in same minute).
+func notifyKey(group, kind string, t time.Time) string {
+	return group + ":" + kind + ":" + t.Format("2006-01-02T15:04")
+}
+
+func broadcastNotify(chats []int64, key, notifyStr string) {
+	for _, chat := range chats {
+		if storage != nil {
+			isNew, err := storage.MarkNotified(chat, key)
+			if err != nil {
+				log.Printf("ERROR: Failed to record notification %s for chatid=%d: %v", key, chat, err)
+			} else if !isNew {
+				continue
+			}
+		}
+
 		msg := tgbotapi.NewMessage(chat, notifyStr)
 		msg.ParseMode = "Markdown"
 		if _, err := bot.Send(msg); err != nil {
@@ -55,3 +143,12 @@ func broadcastNotify(notifyStr string) {
 		}
 	}
 }
+
+func pruneNotified() {
+	if storage == nil {
+		return
+	}
+	if err := storage.PruneNotified(time.Now().Add(-24 * time.Hour)); err != nil {
+		log.Printf("ERROR: Failed to prune sent notifications: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+type OverrideAction int
+
+// Overrides apply to all entries in timeslot, so parallel lessons (e.g. of
+// subgroups) are changed together.
+const (
+	// OverrideAdd puts new entry into timeslot, replacing existing ones (if any).
+	OverrideAdd OverrideAction = 0
+	// OverrideEdit changes some fields of entries in timeslot.
+	OverrideEdit OverrideAction = 1
+	// OverrideCancel removes entries from timeslot.
+	OverrideCancel OverrideAction = 2
+	// OverrideAppend puts new entry into timeslot next to existing ones.
+	OverrideAppend OverrideAction = 3
+)
+
+// Override is manual change to downloaded timetable made by admin.
+type Override struct {
+	ID     int64
+	Group  string
+	Day    time.Time
+	Num    int
+	Action OverrideAction
+
+	// Entry fields for OverrideAdd and OverrideEdit. For OverrideEdit empty
+	// strings and negative Type mean "keep original value".
+	Type      LessonType
+	Classroom string
+	Lecturer  string
+	Name      string
+}
+
+// applyOverrides returns copy of entries for day with overrides applied in order.
+func applyOverrides(day time.Time, entries []Entry, overrides []Override) []Entry {
+	if len(overrides) == 0 {
+		return entries
+	}
+
+	conf := config()
+	res := make([]Entry, len(entries))
+	copy(res, entries)
+
+	for _, o := range overrides {
+		if o.Num < 1 || o.Num > len(conf.TimeslotsBegin) {
+			continue
+		}
+		inSlot := func(ent Entry) bool {
+			return conf.ttindex(TimeSlot{ent.Time.Hour(), ent.Time.Minute()}) == o.Num
+		}
+		newEntry := Entry{
+			TimeSlotSet(day, conf.TimeslotsBegin[o.Num-1]),
+			o.Type,
+			o.Classroom,
+			o.Lecturer,
+			o.Name,
+		}
+
+		switch o.Action {
+		case OverrideAdd:
+			res = append(removeSlot(res, inSlot), newEntry)
+		case OverrideAppend:
+			res = append(res, newEntry)
+		case OverrideEdit:
+			for i := range res {
+				if !inSlot(res[i]) {
+					continue
+				}
+				if o.Type >= 0 {
+					res[i].Type = o.Type
+				}
+				if o.Classroom != "" {
+					res[i].Classroom = o.Classroom
+				}
+				if o.Lecturer != "" {
+					res[i].Lecturer = o.Lecturer
+				}
+				if o.Name != "" {
+					res[i].Name = o.Name
+				}
+			}
+		case OverrideCancel:
+			res = removeSlot(res, inSlot)
+		}
+	}
+
+	// Stable, so parallel entries keep their order.
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Time.Before(res[j].Time)
+	})
+	return res
+}
+
+// removeSlot returns entries for which inSlot is false, reusing entries'
+// backing array.
+func removeSlot(entries []Entry, inSlot func(Entry) bool) []Entry {
+	res := entries[:0]
+	for _, ent := range entries {
+		if !inSlot(ent) {
+			res = append(res, ent)
+		}
+	}
+	return res
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyOverrides(t *testing.T) {
+	timezone = time.UTC
+	currentConfig.Store(&Config{
+		TimeslotsBegin: []TimeSlot{{8, 0}, {9, 50}, {11, 40}},
+	})
+	day := time.Date(2018, 9, 12, 0, 0, 0, 0, time.UTC)
+	at := func(hour, min int) time.Time {
+		return time.Date(2018, 9, 12, hour, min, 0, 0, time.UTC)
+	}
+
+	first := Entry{at(8, 0), Lecture, "101", "Petrov", "Math"}
+	labA := Entry{at(9, 50), Lab, "201", "Ivanov", "Physics"}
+	labB := Entry{at(9, 50), Lab, "202", "Sidorov", "Chemistry"}
+	entries := []Entry{first, labA, labB}
+
+	cases := []struct {
+		name      string
+		overrides []Override
+		want      []Entry
+	}{
+		{
+			"cancel removes all parallel entries",
+			[]Override{{Num: 2, Action: OverrideCancel}},
+			[]Entry{first},
+		},
+		{
+			"add replaces all parallel entries",
+			[]Override{{Num: 2, Action: OverrideAdd, Type: Seminar, Classroom: "300", Lecturer: "Orlov", Name: "History"}},
+			[]Entry{first, {at(9, 50), Seminar, "300", "Orlov", "History"}},
+		},
+		{
+			"edit changes all parallel entries",
+			[]Override{{Num: 2, Action: OverrideEdit, Type: -1, Classroom: "305"}},
+			[]Entry{first, {at(9, 50), Lab, "305", "Ivanov", "Physics"}, {at(9, 50), Lab, "305", "Sidorov", "Chemistry"}},
+		},
+		{
+			"append keeps existing entries",
+			[]Override{
+				{Num: 3, Action: OverrideAdd, Type: Lab, Classroom: "201", Lecturer: "Ivanov", Name: "Physics"},
+				{Num: 3, Action: OverrideAppend, Type: Lab, Classroom: "202", Lecturer: "Sidorov", Name: "Chemistry"},
+			},
+			[]Entry{first, labA, labB, {at(11, 40), Lab, "201", "Ivanov", "Physics"}, {at(11, 40), Lab, "202", "Sidorov", "Chemistry"}},
+		},
+		{
+			"edit of empty slot does nothing",
+			[]Override{{Num: 3, Action: OverrideEdit, Type: -1, Name: "Art"}},
+			entries,
+		},
+		{
+			"invalid number is ignored",
+			[]Override{{Num: 4, Action: OverrideCancel}, {Num: 0, Action: OverrideCancel}},
+			entries,
+		},
+	}
+	for _, c := range cases {
+		orig := append([]Entry(nil), entries...)
+		got := applyOverrides(day, entries, c.overrides)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+		if !reflect.DeepEqual(entries, orig) {
+			t.Errorf("%s: source entries were modified", c.name)
+		}
+	}
+}
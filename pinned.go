@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/slongfield/pyfmt"
+)
+
+// Markers prepended to entries in pinned message.
+const (
+	pinnedDoneMark    = "✅ "
+	pinnedCurrentMark = "▶️ "
+	pinnedChangedMark = "✏️ "
+)
+
+// PinnedMessage is today's timetable message pinned in chat.
+type PinnedMessage struct {
+	ChatID    int64
+	MessageID int
+	Day       time.Time
+	// text is last text message was set to.
+	text string
+}
+
+var (
+	// pinnedUpdateLck serializes updatePinned runs.
+	pinnedUpdateLck sync.Mutex
+
+	pinnedLck sync.Mutex
+	pinned    = make(map[int64]*PinnedMessage)
+	// pinnedChanges contains numbers of lessons changed during the day
+	// for each group.
+	pinnedChanges = make(map[dayKey]map[int]bool)
+)
+
+func loadPinned() error {
+	if storage == nil {
+		return nil
+	}
+	list, err := storage.LoadPinned(timezone)
+	if err != nil {
+		return err
+	}
+
+	pinnedLck.Lock()
+	defer pinnedLck.Unlock()
+	for i := range list {
+		pinned[list[i].ChatID] = &list[i]
+	}
+	return nil
+}
+
+// markPinnedChanges records changes in today's timetable, so they are
+// marked in pinned messages.
+func markPinnedChanges(group string, changes []DayChange) {
+	today := StripTime(time.Now().In(timezone), timezone)
+
+	pinnedLck.Lock()
+	defer pinnedLck.Unlock()
+	for _, change := range changes {
+		if !change.Day.Equal(today) {
+			continue
+		}
+		key := dayKey{group, today}
+		if pinnedChanges[key] == nil {
+			pinnedChanges[key] = make(map[int]bool)
+		}
+		oldByNum := entriesByNum(change.Old)
+		newByNum := entriesByNum(change.New)
+		for num := 1; num <= len(config().TimeslotsBegin); num++ {
+			if !entriesEqual(oldByNum[num], newByNum[num]) {
+				pinnedChanges[key][num] = true
+			}
+		}
+	}
+}
+
+// formatPinned formats today's timetable marking completed, current and
+// changed lessons.
+func formatPinned(now time.Time, entries []Entry, changed map[int]bool) string {
+	hdr := pyfmt.Must(lang().Replies.TimetableHeader, map[string]interface{}{
+		"date": now.Format("_2 January  2006"),
+	})
+	conf := config()
+	entriesStr := make([]string, len(entries))
+	for i, ent := range entries {
+		num := conf.ttindex(TimeSlot{ent.Time.Hour(), ent.Time.Minute()})
+		mark := ""
+		if num != -1 {
+			end := TimeSlotSet(ent.Time, conf.TimeslotsEnd[num-1])
+			switch {
+			case !now.Before(end):
+				mark = pinnedDoneMark
+			case !now.Before(ent.Time):
+				mark = pinnedCurrentMark
+			}
+		}
+		if changed[num] {
+			mark += pinnedChangedMark
+		}
+		entriesStr[i] = mark + formatEntry(ent)
+	}
+	if len(entriesStr) == 0 {
+		entriesStr = append(entriesStr, lang().Replies.Empty)
+	}
+	return hdr + strings.Join(entriesStr, "\n\n")
+}
+
+// postPinned sends and pins today's timetable in chat. Message is recorded
+// even if it can't be pinned (e.g. bot is not chat admin), so it's still
+// kept up to date instead of being posted again.
+func postPinned(chatID int64, now time.Time, text string) (*PinnedMessage, error) {
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = "Markdown"
+	msg.DisableNotification = true
+	sent, err := bot.Send(msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "send")
+	}
+	_, err = bot.PinChatMessage(tgbotapi.PinChatMessageConfig{
+		ChatID:              chatID,
+		MessageID:           sent.MessageID,
+		DisableNotification: true,
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to pin message %d in chatid=%d: %v\n", sent.MessageID, chatID, err)
+	}
+
+	p := &PinnedMessage{chatID, sent.MessageID, StripTime(now, timezone), text}
+	if storage != nil {
+		if err := storage.SavePinned(*p); err != nil {
+			log.Printf("ERROR: Failed to save pinned message for chatid=%d: %v\n", chatID, err)
+		}
+	}
+	return p, nil
+}
+
+// pinnedUpdate is change of pinned message collected by updatePinned.
+type pinnedUpdate struct {
+	chat int64
+	text string
+	// messageID is message to edit, zero if new message should be posted.
+	messageID int
+}
+
+// updatePinned posts pinned messages at groups' pin_at time and keeps
+// today's pinned messages up to date. pinnedLck is not held during
+// requests to Telegram, so change notifications are not blocked by them.
+func updatePinned(ctx context.Context) {
+	now := time.Now().In(timezone)
+	today := StripTime(now, timezone)
+	nowSlot := TimeSlot{now.Hour(), now.Minute()}
+
+	// Overlapping runs would post message twice.
+	pinnedUpdateLck.Lock()
+	defer pinnedUpdateLck.Unlock()
+
+	updates := []pinnedUpdate{}
+	for name, group := range config().Groups {
+		if ctx.Err() != nil {
+			return
+		}
+		if len(group.PinChats) == 0 {
+			continue
+		}
+		entries, err := cache.OnDay(name, now)
+		if err != nil {
+			log.Printf("ERROR: While querying entries of %s for %v: %v.\n", name, now, err)
+			continue
+		}
+
+		pinnedLck.Lock()
+		text := formatPinned(now, entries, pinnedChanges[dayKey{name, today}])
+		for _, chat := range group.PinChats {
+			p, prs := pinned[chat]
+			if !prs || !p.Day.Equal(today) {
+				if group.PinAt != nil && nowSlot == *group.PinAt && len(entries) != 0 {
+					updates = append(updates, pinnedUpdate{chat, text, 0})
+				}
+				continue
+			}
+			if p.text != text {
+				updates = append(updates, pinnedUpdate{chat, text, p.MessageID})
+			}
+		}
+		pinnedLck.Unlock()
+	}
+
+	for _, u := range updates {
+		if ctx.Err() != nil {
+			return
+		}
+		if u.messageID == 0 {
+			p, err := postPinned(u.chat, now, u.text)
+			if err != nil {
+				log.Printf("ERROR: Failed to post pinned message to chatid=%d: %v\n", u.chat, err)
+				continue
+			}
+			pinnedLck.Lock()
+			pinned[u.chat] = p
+			pinnedLck.Unlock()
+			continue
+		}
+
+		edit := tgbotapi.NewEditMessageText(u.chat, u.messageID, u.text)
+		edit.ParseMode = "Markdown"
+		if _, err := bot.Send(edit); err != nil {
+			log.Printf("ERROR: Failed to update pinned message in chatid=%d: %v\n", u.chat, err)
+		}
+		// Don't retry failed edit (e.g. if message was deleted) until
+		// text changes again.
+		pinnedLck.Lock()
+		pinned[u.chat].text = u.text
+		pinnedLck.Unlock()
+	}
+
+	pinnedLck.Lock()
+	defer pinnedLck.Unlock()
+	// Forget changes of previous days.
+	for key := range pinnedChanges {
+		if key.day.Before(today) {
+			delete(pinnedChanges, key)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type PrefetchConfig struct {
+	// IntervalMins is how often to refresh current and next week.
+	// Zero disables prefetching.
+	IntervalMins int `yaml:"interval_mins"`
+	// JitterSecs is maximum random delay added before each refresh.
+	JitterSecs int `yaml:"jitter_secs"`
+	// MaxBackoffMins limits delay between retries after failed refresh.
+	MaxBackoffMins int `yaml:"max_backoff_mins"`
+}
+
+type prefetchState struct {
+	failures int
+	retryAt  time.Time
+}
+
+var (
+	// prefetchLck prevents concurrent prefetch runs, e.g. initial one
+	// and scheduled one.
+	prefetchLck sync.Mutex
+	// prefetchStates contains retry state of each group.
+	prefetchStates = make(map[string]*prefetchState)
+)
+
+// prefetch downloads current and next week of each group, so user
+// commands can be served from cache.
+func prefetch(ctx context.Context) {
+	if config().Prefetch.JitterSecs > 0 {
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(config().Prefetch.JitterSecs) * int64(time.Second)))):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	prefetchLck.Lock()
+	defer prefetchLck.Unlock()
+
+	for _, group := range groupNames() {
+		if ctx.Err() != nil {
+			return
+		}
+		state, prs := prefetchStates[group]
+		if !prs {
+			state = &prefetchState{}
+			prefetchStates[group] = state
+		}
+		if time.Now().Before(state.retryAt) {
+			continue
+		}
+
+		now := time.Now().In(timezone)
+		err := cache.Refresh(group, now)
+		if err == nil {
+			err = cache.Refresh(group, now.AddDate(0, 0, 7))
+		}
+		if err != nil {
+			state.failures++
+			state.retryAt = time.Now().Add(prefetchBackoff(state.failures))
+			log.Printf("ERROR: Failed to prefetch table for %s (%d failures in row), next try at %v: %v\n",
+				group, state.failures, state.retryAt.Format("15:04:05"), err)
+			continue
+		}
+		state.failures = 0
+		state.retryAt = time.Time{}
+	}
+}
+
+// prefetchBackoff returns delay before next refresh attempt after specified
+// amount of consecutive failures.
+func prefetchBackoff(failures int) time.Duration {
+	interval := time.Duration(config().Prefetch.IntervalMins) * time.Minute
+	maxBackoff := time.Duration(config().Prefetch.MaxBackoffMins) * time.Minute
+
+	backoff := interval
+	for i := 0; i < failures; i++ {
+		backoff *= 2
+		if maxBackoff != 0 && backoff >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return backoff
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strings"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// maxPanicReport limits length of panic report sent to admins, Telegram
+// rejects messages longer than 4096 characters.
+const maxPanicReport = 3500
+
+// handleUpdateSafely handles update, recovering from panic so bug triggered
+// by single update doesn't kill worker and whole bot.
+func handleUpdateSafely(update tgbotapi.Update) {
+	defer func() {
+		if r := recover(); r != nil {
+			notifyPanicSender(update)
+			reportPanic(fmt.Sprintf("processing update %d", update.UpdateID), r)
+		}
+	}()
+	handleUpdate(update)
+}
+
+// recoverJob recovers from panic in background goroutine and reports it.
+// It should be deferred directly, otherwise recover() has no effect.
+func recoverJob(what string) {
+	if r := recover(); r != nil {
+		reportPanic(what, r)
+	}
+}
+
+// reportPanic logs recovered panic value r with stack trace and sends it to
+// admins if enabled in config. what describes interrupted operation.
+func reportPanic(what string, r interface{}) {
+	stack := debug.Stack()
+	log.Printf("ERROR: panic while %s: %v\n%s", what, r, stack)
+
+	if !config().ReportPanics {
+		return
+	}
+	report := fmt.Sprintf("Panic while %s: %v\n\n%s", what, r, stack)
+	if len(report) > maxPanicReport {
+		report = strings.ToValidUTF8(report[:maxPanicReport], "") + "..."
+	}
+	for _, admin := range config().Admins {
+		// Not Markdown, stack trace would break formatting.
+		if _, err := bot.Send(tgbotapi.NewMessage(int64(admin), report)); err != nil {
+			log.Printf("ERROR: Failed to report panic to %d: %v\n", admin, err)
+		}
+	}
+}
+
+// notifyPanicSender tells user whose update caused panic that something
+// went wrong. Inline queries are left unanswered.
+func notifyPanicSender(update tgbotapi.Update) {
+	var err error
+	switch {
+	case update.CallbackQuery != nil:
+		_, err = bot.AnswerCallbackQuery(tgbotapi.NewCallback(update.CallbackQuery.ID, lang().Replies.SomethingBroke))
+	case update.Message != nil:
+		_, err = replyTo(update.Message, lang().Replies.SomethingBroke, nil)
+	}
+	if err != nil {
+		log.Println("ERROR: Failed to notify about panic:", err)
+	}
+}
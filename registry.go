@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/slongfield/pyfmt"
+)
+
+type command struct {
+	name    string
+	aliases []string
+	args    []argSpec
+	role    Role
+	handler func(msg *tgbotapi.Message, args cmdArgs) error
+}
+
+// argKind selects how command argument is parsed.
+type argKind int
+
+const (
+	// argWord is single word.
+	argWord argKind = 0
+	// argDate is date in any format accepted by parseDate.
+	argDate argKind = 1
+	// argRest takes all remaining text, it can be only last argument.
+	argRest argKind = 2
+)
+
+// argSpec describes command argument. Arguments are checked by
+// dispatchCommand, so handlers get only valid ones.
+type argSpec struct {
+	// name is key of lang.ArgNames, used in help and to get value.
+	name     string
+	kind     argKind
+	optional bool
+}
+
+// commands contains all registered commands in order they are listed in help.
+var commands []*command
+
+// commandsByName maps names and aliases to commands.
+var commandsByName = make(map[string]*command)
+
+func init() {
+	date := argSpec{name: "date", kind: argDate}
+	num := argSpec{name: "num", kind: argWord}
+
+	registerCommands(
+		&command{name: "help", aliases: []string{"start"}, args: []argSpec{{name: "command", kind: argWord, optional: true}}, role: RoleUser, handler: helpCmd},
+		&command{name: "adminhelp", role: RoleUser, handler: adminHelpCmd},
+		&command{name: "today", role: RoleUser, handler: todayCmd},
+		&command{name: "tomorrow", role: RoleUser, handler: tomorrowCmd},
+		&command{name: "schedule", args: []argSpec{date}, role: RoleUser, handler: scheduleCmd},
+		&command{name: "week", args: []argSpec{{name: "date", kind: argDate, optional: true}}, role: RoleUser, handler: weekCmd},
+		&command{name: "next", role: RoleUser, handler: nextCmd},
+		&command{name: "exams", role: RoleUser, handler: examsCmd},
+		&command{name: "find", args: []argSpec{{name: "query", kind: argRest}}, role: RoleUser, handler: findCmd},
+		&command{name: "timetable", role: RoleUser, handler: timetableCmd},
+		&command{name: "ics", args: []argSpec{{name: "from", kind: argDate, optional: true}, {name: "to", kind: argDate, optional: true}}, role: RoleUser, handler: icsCmd},
+		&command{name: "setgroup", args: []argSpec{{name: "group", kind: argWord, optional: true}}, role: RoleUser, handler: setGroupCmd},
+		&command{name: "subscribe", role: RoleUser, handler: subscribeCmd},
+		&command{name: "unsubscribe", role: RoleUser, handler: unsubscribeCmd},
+		&command{name: "notify", args: []argSpec{{name: "setting", kind: argWord, optional: true}, {name: "value", kind: argRest, optional: true}}, role: RoleUser, handler: notifyCmd},
+		&command{name: "digest", args: []argSpec{{name: "day", kind: argWord, optional: true}, {name: "time", kind: argWord, optional: true}}, role: RoleUser, handler: digestCmd},
+
+		&command{name: "evict", args: []argSpec{date}, role: RoleAdmin, handler: evictCmd},
+		&command{name: "add", args: []argSpec{date, num, {name: "entry", kind: argRest}}, role: RoleAdmin, handler: addCmd},
+		&command{name: "edit", args: []argSpec{date, num, {name: "field", kind: argWord}, {name: "value", kind: argRest}}, role: RoleAdmin, handler: editCmd},
+		&command{name: "cancel", args: []argSpec{date, num}, role: RoleAdmin, handler: cancelCmd},
+		&command{name: "move", args: []argSpec{date, num, {name: "newdate", kind: argDate}, {name: "newnum", kind: argWord}}, role: RoleAdmin, handler: moveCmd},
+		&command{name: "reset", args: []argSpec{date, num}, role: RoleAdmin, handler: resetCmd},
+		&command{name: "stats", role: RoleAdmin, handler: statsCmd},
+		&command{name: "reload", role: RoleAdmin, handler: reloadCmd},
+	)
+}
+
+func registerCommands(cmds ...*command) {
+	for _, cmd := range cmds {
+		for _, name := range append([]string{cmd.name}, cmd.aliases...) {
+			if _, prs := commandsByName[name]; prs {
+				panic("command " + name + " registered twice")
+			}
+			commandsByName[name] = cmd
+		}
+		commands = append(commands, cmd)
+	}
+}
+
+// dispatchCommand invokes command handler if sender has required permissions
+// and arguments are valid. Otherwise, error or usage help is sent.
+func dispatchCommand(cmd *command, msg *tgbotapi.Message) error {
+	if !hasRole(msg, cmd.role) {
+		return reply(msg, lang().Replies.MissingPermissions)
+	}
+
+	args, err := parseArgs(cmd.args, msg.CommandArguments(), time.Now())
+	if err == errInvalidDate {
+		return reply(msg, lang().Replies.InvalidDate)
+	}
+	if err != nil {
+		return reply(msg, cmd.usage(msg))
+	}
+	return cmd.handler(msg, args)
+}
+
+// cmdArgs contains command arguments parsed according to argSpecs, keyed
+// by argument name. Missing optional arguments are absent.
+type cmdArgs struct {
+	values map[string]string
+	dates  map[string]time.Time
+}
+
+func (a cmdArgs) has(name string) bool {
+	_, prs := a.values[name]
+	return prs
+}
+
+func (a cmdArgs) str(name string) string {
+	return a.values[name]
+}
+
+// date returns value of argDate argument.
+func (a cmdArgs) date(name string) time.Time {
+	return a.dates[name]
+}
+
+var (
+	errUsage       = errors.New("invalid command arguments")
+	errInvalidDate = errors.New("invalid date")
+)
+
+var wordRe = regexp.MustCompile(`\S+`)
+
+// maxDateWords is the longest date accepted by parseDate in words, e.g.
+// "day after tomorrow".
+const maxDateWords = 3
+
+// countRequired returns amount of required arguments in specs.
+func countRequired(specs []argSpec) int {
+	res := 0
+	for _, spec := range specs {
+		if !spec.optional {
+			res++
+		}
+	}
+	return res
+}
+
+// parseArgs splits text into arguments described by specs. errInvalidDate
+// is returned for invalid dates, errUsage for other problems.
+func parseArgs(specs []argSpec, text string, now time.Time) (cmdArgs, error) {
+	res := cmdArgs{make(map[string]string), make(map[string]time.Time)}
+	words := wordRe.FindAllStringIndex(text, -1)
+	i := 0
+	for j, spec := range specs {
+		if i == len(words) {
+			if !spec.optional {
+				return res, errUsage
+			}
+			continue
+		}
+
+		word := text[words[i][0]:words[i][1]]
+		switch spec.kind {
+		case argWord:
+			res.values[spec.name] = word
+			i++
+		case argDate:
+			// Date can span several words, longest prefix that is valid date
+			// is used. Words needed by following required arguments are
+			// left for them.
+			n := len(words) - i - countRequired(specs[j+1:])
+			if n <= 0 {
+				return res, errUsage
+			}
+			if n > maxDateWords {
+				n = maxDateWords
+			}
+			parsed := false
+			for ; n > 0; n-- {
+				str := text[words[i][0]:words[i+n-1][1]]
+				day, err := parseDate(str, now)
+				if err != nil {
+					continue
+				}
+				res.values[spec.name] = str
+				res.dates[spec.name] = day
+				i += n
+				parsed = true
+				break
+			}
+			if !parsed {
+				return res, errInvalidDate
+			}
+		case argRest:
+			res.values[spec.name] = strings.TrimSpace(text[words[i][0]:])
+			i = len(words)
+		}
+	}
+	if i != len(words) {
+		return res, errUsage
+	}
+	return res, nil
+}
+
+// usageLine returns command with arguments, e.g. "/schedule DATE".
+func (cmd *command) usageLine() string {
+	parts := []string{"/" + cmd.name}
+	for _, arg := range cmd.args {
+		name := lang().ArgNames[arg.name]
+		if arg.optional {
+			name = "[" + name + "]"
+		}
+		parts = append(parts, name)
+	}
+	return strings.Join(parts, " ")
+}
+
+// usage returns text sent if command's arguments are invalid. Commands
+// without usage in lang file get generated one.
+func (cmd *command) usage(msg *tgbotapi.Message) string {
+	tmpl, prs := lang().Usage[cmd.name]
+	if !prs {
+		return pyfmt.Must(lang().Replies.Usage, map[string]interface{}{
+			"command": cmd.usageLine(),
+		})
+	}
+	return pyfmt.Must(tmpl, map[string]interface{}{
+		"groups":  strings.Join(groupNames(), ", "),
+		"current": chatGroup(msg.Chat.ID),
+	})
+}
+
+// commandsHelp generates help text for all commands with role accepted by filter.
+func commandsHelp(filter func(Role) bool) string {
+	lines := []string{}
+	for _, cmd := range commands {
+		if !filter(cmd.role) {
+			continue
+		}
+		usage := cmd.usageLine()
+		if len(cmd.aliases) != 0 {
+			usage += " (/" + strings.Join(cmd.aliases, ", /") + ")"
+		}
+		lines = append(lines, pyfmt.Must(lang().CommandHelpFormat, map[string]interface{}{
+			"command":     usage,
+			"description": lang().Commands[cmd.name],
+		}))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// setBotCommands sends list of commands available to everyone to Telegram
+// so clients can show them in menu.
+func setBotCommands() error {
+	type botCommand struct {
+		Command     string `json:"command"`
+		Description string `json:"description"`
+	}
+
+	list := []botCommand{}
+	for _, cmd := range commands {
+		if cmd.role != RoleUser {
+			continue
+		}
+		list = append(list, botCommand{cmd.name, lang().Commands[cmd.name]})
+	}
+
+	blob, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	if _, err := bot.MakeRequest("setMyCommands", url.Values{"commands": {string(blob)}}); err != nil {
+		return errors.Wrap(err, "setMyCommands")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseArgsDates(t *testing.T) {
+	timezone = time.UTC
+	// Wednesday.
+	now := time.Date(2018, 9, 12, 15, 4, 5, 0, time.UTC)
+	date := argSpec{name: "date", kind: argDate}
+	num := argSpec{name: "num", kind: argWord}
+	move := []argSpec{date, num, {name: "newdate", kind: argDate}, {name: "newnum", kind: argWord}}
+	ics := []argSpec{{name: "from", kind: argDate, optional: true}, {name: "to", kind: argDate, optional: true}}
+
+	cases := []struct {
+		specs  []argSpec
+		text   string
+		values map[string]string
+		err    error
+	}{
+		{[]argSpec{date}, "day after tomorrow", map[string]string{"date": "day after tomorrow"}, nil},
+		{[]argSpec{date, num}, "next friday 2", map[string]string{"date": "next friday", "num": "2"}, nil},
+		{[]argSpec{date, num}, "in 2 days 3", map[string]string{"date": "in 2 days", "num": "3"}, nil},
+		{move, "next mon 1 day after tomorrow 4", map[string]string{
+			"date": "next mon", "num": "1", "newdate": "day after tomorrow", "newnum": "4",
+		}, nil},
+		{ics, "this monday next friday", map[string]string{"from": "this monday", "to": "next friday"}, nil},
+		{ics, "today tomorrow", map[string]string{"from": "today", "to": "tomorrow"}, nil},
+		{ics, "", map[string]string{}, nil},
+
+		{[]argSpec{date}, "", nil, errUsage},
+		{[]argSpec{date}, "someday", nil, errInvalidDate},
+		{[]argSpec{date, num}, "tomorrow", nil, errUsage},
+		{[]argSpec{date}, "tomorrow 2", nil, errUsage},
+	}
+	for _, c := range cases {
+		args, err := parseArgs(c.specs, c.text, now)
+		if err != c.err {
+			t.Errorf("parseArgs(%q): error %v, want %v", c.text, err, c.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(args.values) != len(c.values) {
+			t.Errorf("parseArgs(%q) = %v, want %v", c.text, args.values, c.values)
+			continue
+		}
+		for name, want := range c.values {
+			if got := args.str(name); got != want {
+				t.Errorf("parseArgs(%q): %s = %q, want %q", c.text, name, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/slongfield/pyfmt"
+	"gopkg.in/yaml.v2"
+)
+
+// configPath is path of config file passed on command line, it's re-read
+// on reload.
+var configPath string
+
+var (
+	// currentConfig and currentLang hold *Config and *LangStrings. They are
+	// replaced as a whole on reload, so values returned by config() and
+	// lang() must not be modified.
+	currentConfig atomic.Value
+	currentLang   atomic.Value
+
+	// reloadLck serializes reloads so concurrent SIGHUP and /reload don't
+	// check restart-only settings against stale config.
+	reloadLck sync.Mutex
+)
+
+func config() *Config {
+	return currentConfig.Load().(*Config)
+}
+
+func lang() *LangStrings {
+	return currentLang.Load().(*LangStrings)
+}
+
+// loadConfig reads and validates config file and lang file referenced by
+// it. ValidationError is returned if files are decoded but invalid.
+func loadConfig(path string) (*Config, *LangStrings, error) {
+	problems := []error{}
+	// decode collects type errors as problems, so config can be validated
+	// further even if some values are invalid.
+	decode := func(blob []byte, out interface{}) error {
+		err := yaml.UnmarshalStrict(blob, out)
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			for _, msg := range typeErr.Errors {
+				problems = append(problems, errors.New(msg))
+			}
+			return nil
+		}
+		return err
+	}
+
+	conf := &Config{}
+	confFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read config file")
+	}
+	if err := decode(confFile, conf); err != nil {
+		return nil, nil, errors.Wrap(err, "decode config file")
+	}
+
+	if err := conf.upgradeLegacy(); err != nil {
+		problems = append(problems, err)
+	}
+
+	strs := &LangStrings{}
+	langFile, err := ioutil.ReadFile(conf.Lang)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read lang file")
+	}
+	if err := decode(langFile, strs); err != nil {
+		return nil, nil, errors.Wrap(err, "decode lang file")
+	}
+
+	problems = append(problems, conf.Validate()...)
+	problems = append(problems, strs.Validate()...)
+	if len(problems) != 0 {
+		return nil, nil, ValidationError(problems)
+	}
+	return conf, strs, nil
+}
+
+// restartOnlyChanges lists settings that can't be applied without restart
+// and differ between old and new.
+func restartOnlyChanges(old, new *Config) []string {
+	res := []string{}
+	check := func(name string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			res = append(res, name)
+		}
+	}
+	check("token", old.Token, new.Token)
+	check("driver", old.Driver, new.Driver)
+	check("dsn", old.DSN, new.DSN)
+	check("cmd_processing_goroutines", old.CmdProcGoroutines, new.CmdProcGoroutines)
+	check("timezone", old.TimeZone, new.TimeZone)
+	// Cached and stored entries are matched to lessons by start time.
+	check("timeslots_begin", old.TimeslotsBegin, new.TimeslotsBegin)
+	check("prefetch.interval_mins", old.Prefetch.IntervalMins, new.Prefetch.IntervalMins)
+	check("http.listen", old.HTTP.Listen, new.HTTP.Listen)
+	check("webhook", old.Webhook, new.Webhook)
+
+	// Timetable sources are created once by NewCache.
+	for name, group := range new.Groups {
+		if oldGroup, prs := old.Groups[name]; !prs || !reflect.DeepEqual(oldGroup.Source, group.Source) {
+			res = append(res, "groups."+name+".source")
+		}
+	}
+	for name := range old.Groups {
+		if _, prs := new.Groups[name]; !prs {
+			res = append(res, "groups."+name)
+		}
+	}
+	return res
+}
+
+// reloadConfig re-reads config and lang files and replaces current ones.
+// Nothing is changed if files are invalid or settings that require restart
+// were changed.
+func reloadConfig() error {
+	reloadLck.Lock()
+	defer reloadLck.Unlock()
+
+	conf, strs, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if changed := restartOnlyChanges(config(), conf); len(changed) != 0 {
+		return errors.Errorf("restart is required to change %s", strings.Join(changed, ", "))
+	}
+
+	currentConfig.Store(conf)
+	currentLang.Store(strs)
+	log.Println("Configuration reloaded from", configPath)
+
+	// Command descriptions could change in lang file.
+	if err := setBotCommands(); err != nil {
+		log.Println("ERROR: Failed to set bot commands list:", err)
+	}
+	return nil
+}
+
+func reloadCmd(msg *tgbotapi.Message, _ cmdArgs) error {
+	if err := reloadConfig(); err != nil {
+		log.Println("ERROR: Failed to reload configuration:", err)
+		return reply(msg, pyfmt.Must(lang().Replies.ReloadFailed, map[string]interface{}{
+			"error": err.Error(),
+		}))
+	}
+	return reply(msg, lang().Replies.Reloaded)
+}
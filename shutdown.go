@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// defaultShutdownTimeout is used if shutdown_timeout_secs is not set.
+const defaultShutdownTimeout = 10 * time.Second
+
+// jobTracker allows to wait for running background jobs and prevents
+// starting new ones after shutdown has begun.
+type jobTracker struct {
+	lck      sync.Mutex
+	stopping bool
+	wg       sync.WaitGroup
+}
+
+var jobs jobTracker
+
+// start registers new job, false is returned if shutdown has begun.
+func (t *jobTracker) start() bool {
+	t.lck.Lock()
+	defer t.lck.Unlock()
+	if t.stopping {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *jobTracker) done() {
+	t.wg.Done()
+}
+
+// stop prevents new jobs from starting and returns channel closed when all
+// running jobs are done.
+func (t *jobTracker) stop() <-chan struct{} {
+	t.lck.Lock()
+	t.stopping = true
+	t.lck.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// tracked wraps function so it's tracked by jobs. Panic in f is recovered
+// and reported, what describes job in report.
+func tracked(what string, f func()) func() {
+	return func() {
+		if !jobs.start() {
+			return
+		}
+		defer jobs.done()
+		defer recoverJob(what)
+		f()
+	}
+}
+
+func systemdNotify(args ...string) {
+	if os.Getenv("USING_SYSTEMD") != "1" {
+		return
+	}
+	cmd := exec.Command("systemd-notify", args...)
+	if out, err := cmd.Output(); err != nil {
+		log.Println("Failed to notify systemd:", err)
+		log.Println(string(out))
+	}
+}
+
+// drainCheckInterval is how often shutdown checks whether updates channel
+// is drained.
+const drainCheckInterval = 50 * time.Millisecond
+
+// shutdown stops everything started by main. Intake of updates is stopped
+// first (webhook server or long polling, using stopPolling), then updates
+// already in channel are processed and only then stopWorkers cancels
+// context of update workers and jobs. schedulers are stop channels returned
+// by gocron. Everything is given config.ShutdownTimeoutSecs to finish.
+func shutdown(stopPolling context.CancelFunc, updates tgbotapi.UpdatesChannel, stopWorkers context.CancelFunc,
+	workers *sync.WaitGroup, schedulers ...chan bool) {
+	systemdNotify("--stopping", "--status=Stopping")
+
+	timeout := time.Duration(config().ShutdownTimeoutSecs) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, stop := range schedulers {
+		stop <- true
+	}
+
+	// Stop accepting updates and API requests.
+	stopPolling()
+	if webhookServer != nil {
+		if err := webhookServer.Shutdown(ctx); err != nil {
+			log.Println("ERROR: Failed to stop webhook listener:", err)
+		}
+	}
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Println("ERROR: Failed to stop HTTP server:", err)
+		}
+	}
+
+	// Process updates that were already received.
+	for len(updates) != 0 && ctx.Err() == nil {
+		time.Sleep(drainCheckInterval)
+	}
+	if len(updates) != 0 {
+		log.Printf("ERROR: Timed out processing received updates, %d updates are dropped\n", len(updates))
+	}
+	stopWorkers()
+
+	workersDone := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(workersDone)
+	}()
+	jobsDone := jobs.stop()
+	for _, done := range []<-chan struct{}{workersDone, jobsDone} {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.Println("ERROR: Timed out waiting for running commands and jobs, some of them are interrupted")
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if err := cache.Close(); err != nil {
+		log.Println("ERROR: Failed to close cache:", err)
+	}
+	if storage != nil {
+		if err := storage.Close(); err != nil {
+			log.Println("ERROR: Failed to close storage:", err)
+		}
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// Schema upgrades, applied in order. Index in slice + 1 is schema version.
+// Never change existing entries, append new ones instead.
+var schemaUpgrades = []string{
+	`CREATE TABLE days (
+		day TEXT PRIMARY KEY NOT NULL,
+		retrieved_on INTEGER NOT NULL
+	);
+	CREATE TABLE entries (
+		day TEXT NOT NULL REFERENCES days(day) ON DELETE CASCADE,
+		time INTEGER NOT NULL,
+		type INTEGER NOT NULL,
+		classroom TEXT NOT NULL,
+		lecturer TEXT NOT NULL,
+		name TEXT NOT NULL
+	);
+	CREATE INDEX entries_day ON entries(day);
+	CREATE TABLE sent_notifications (
+		chat_id INTEGER NOT NULL,
+		key TEXT NOT NULL,
+		sent_on INTEGER NOT NULL,
+		PRIMARY KEY (chat_id, key)
+	);`,
+	`CREATE TABLE overrides (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		day TEXT NOT NULL,
+		num INTEGER NOT NULL,
+		action INTEGER NOT NULL,
+		type INTEGER NOT NULL,
+		classroom TEXT NOT NULL,
+		lecturer TEXT NOT NULL,
+		name TEXT NOT NULL
+	);`,
+	// Downloaded entries are dropped since they can be downloaded again.
+	`DROP TABLE entries;
+	DROP TABLE days;
+	CREATE TABLE days (
+		grp TEXT NOT NULL,
+		day TEXT NOT NULL,
+		retrieved_on INTEGER NOT NULL,
+		PRIMARY KEY (grp, day)
+	);
+	CREATE TABLE entries (
+		grp TEXT NOT NULL,
+		day TEXT NOT NULL,
+		time INTEGER NOT NULL,
+		type INTEGER NOT NULL,
+		classroom TEXT NOT NULL,
+		lecturer TEXT NOT NULL,
+		name TEXT NOT NULL,
+		FOREIGN KEY (grp, day) REFERENCES days(grp, day) ON DELETE CASCADE
+	);
+	CREATE INDEX entries_day ON entries(grp, day);
+	ALTER TABLE overrides ADD COLUMN grp TEXT NOT NULL DEFAULT '';
+	CREATE TABLE chat_groups (
+		chat_id INTEGER PRIMARY KEY NOT NULL,
+		grp TEXT NOT NULL
+	);`,
+	// Times of day are stored as minutes since midnight.
+	`CREATE TABLE subscriptions (
+		chat_id INTEGER PRIMARY KEY NOT NULL,
+		lead_mins INTEGER NOT NULL,
+		events INTEGER NOT NULL,
+		quiet_from INTEGER NOT NULL,
+		quiet_to INTEGER NOT NULL,
+		summary_at INTEGER NOT NULL
+	);`,
+	`CREATE TABLE digests (
+		chat_id INTEGER NOT NULL,
+		at INTEGER NOT NULL,
+		day_offset INTEGER NOT NULL,
+		PRIMARY KEY (chat_id, at)
+	);`,
+	`CREATE TABLE pinned_messages (
+		chat_id INTEGER PRIMARY KEY NOT NULL,
+		message_id INTEGER NOT NULL,
+		day TEXT NOT NULL
+	);`,
+}
+
+const dayKeyFormat = "2006-01-02"
+
+// Storage persists downloaded timetable and bot state in SQL database.
+type Storage struct {
+	db *sql.DB
+}
+
+func OpenStorage(driver, dsn string) (*Storage, error) {
+	// Put relative database paths into systemd's StateDirectory if we have one.
+	if driver == "sqlite3" && !filepath.IsAbs(dsn) && os.Getenv("STATE_DIRECTORY") != "" {
+		dsn = filepath.Join(os.Getenv("STATE_DIRECTORY"), dsn)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "db open")
+	}
+	if driver == "sqlite3" {
+		// SQLite doesn't like concurrent writes.
+		db.SetMaxOpenConns(1)
+		if _, err := db.Exec(`PRAGMA foreign_keys = ON`); err != nil {
+			db.Close()
+			return nil, errors.Wrap(err, "enable foreign keys")
+		}
+	}
+
+	s := &Storage{db}
+	if err := s.upgradeSchema(); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "schema upgrade")
+	}
+	return s, nil
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+func (s *Storage) upgradeSchema() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+
+	version := 0
+	err := s.db.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+	if err == sql.ErrNoRows {
+		if _, err := s.db.Exec(`INSERT INTO schema_version VALUES (0)`); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	for ; version < len(schemaUpgrades); version++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(schemaUpgrades[version]); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "upgrade to version %d", version+1)
+		}
+		if _, err := tx.Exec(`UPDATE schema_version SET version = ?`, version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveDay replaces stored entries for specified group and day.
+func (s *Storage) SaveDay(group string, day time.Time, entries []Entry, retrievedOn time.Time) error {
+	key := day.Format(dayKeyFormat)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM entries WHERE grp = ? AND day = ?`, group, key); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO days VALUES (?, ?, ?)`, group, key, retrievedOn.Unix()); err != nil {
+		return err
+	}
+	for _, ent := range entries {
+		_, err := tx.Exec(`INSERT INTO entries VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			group, key, ent.Time.Unix(), int(ent.Type), ent.Classroom, ent.Lecturer, ent.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LoadDay returns stored entries for specified group and day and time when
+// they were downloaded. Zero retrievedOn is returned if there is nothing
+// stored for day.
+func (s *Storage) LoadDay(group string, day time.Time) (entries []Entry, retrievedOn time.Time, err error) {
+	key := day.Format(dayKeyFormat)
+
+	var retrievedOnUnix int64
+	err = s.db.QueryRow(`SELECT retrieved_on FROM days WHERE grp = ? AND day = ?`, group, key).Scan(&retrievedOnUnix)
+	if err == sql.ErrNoRows {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	rows, err := s.db.Query(`SELECT time, type, classroom, lecturer, name FROM entries WHERE grp = ? AND day = ? ORDER BY time`, group, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer rows.Close()
+
+	entries = []Entry{}
+	for rows.Next() {
+		var ent Entry
+		var entTime int64
+		var entType int
+		if err := rows.Scan(&entTime, &entType, &ent.Classroom, &ent.Lecturer, &ent.Name); err != nil {
+			return nil, time.Time{}, err
+		}
+		ent.Time = time.Unix(entTime, 0).In(day.Location())
+		ent.Type = LessonType(entType)
+		entries = append(entries, ent)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+	return entries, time.Unix(retrievedOnUnix, 0), nil
+}
+
+// DeleteDay removes group's day with its entries. Entries are deleted
+// explicitly since foreign_keys pragma is set only on one connection.
+func (s *Storage) DeleteDay(group string, day time.Time) error {
+	key := day.Format(dayKeyFormat)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM entries WHERE grp = ? AND day = ?`, group, key); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM days WHERE grp = ? AND day = ?`, group, key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PruneDays removes days before specified one with their entries.
+func (s *Storage) PruneDays(before time.Time) error {
+	key := before.Format(dayKeyFormat)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM entries WHERE day < ?`, key); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM days WHERE day < ?`, key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MarkNotified records that notification identified by key was sent to chat.
+// It returns false if it was already recorded before.
+func (s *Storage) MarkNotified(chatID int64, key string) (bool, error) {
+	res, err := s.db.Exec(`INSERT OR IGNORE INTO sent_notifications VALUES (?, ?, ?)`,
+		chatID, key, time.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected != 0, nil
+}
+
+// PruneNotified forgets about notifications sent before specified time.
+func (s *Storage) PruneNotified(before time.Time) error {
+	_, err := s.db.Exec(`DELETE FROM sent_notifications WHERE sent_on < ?`, before.Unix())
+	return err
+}
+
+// SaveOverride stores override and returns ID assigned to it.
+func (s *Storage) SaveOverride(o Override) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO overrides (grp, day, num, action, type, classroom, lecturer, name) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		o.Group, o.Day.Format(dayKeyFormat), o.Num, int(o.Action), int(o.Type), o.Classroom, o.Lecturer, o.Name)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// LoadOverrides returns all stored overrides ordered by ID.
+// Days are interpreted as in specified location.
+func (s *Storage) LoadOverrides(loc *time.Location) ([]Override, error) {
+	rows, err := s.db.Query(`SELECT id, grp, day, num, action, type, classroom, lecturer, name FROM overrides ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []Override{}
+	for rows.Next() {
+		var o Override
+		var day string
+		var action, entType int
+		if err := rows.Scan(&o.ID, &o.Group, &day, &o.Num, &action, &entType, &o.Classroom, &o.Lecturer, &o.Name); err != nil {
+			return nil, err
+		}
+		o.Day, err = time.ParseInLocation(dayKeyFormat, day, loc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "override %d", o.ID)
+		}
+		o.Action = OverrideAction(action)
+		o.Type = LessonType(entType)
+		res = append(res, o)
+	}
+	return res, rows.Err()
+}
+
+// DeleteOverrides removes all overrides for specified group's timeslot.
+func (s *Storage) DeleteOverrides(group string, day time.Time, num int) error {
+	_, err := s.db.Exec(`DELETE FROM overrides WHERE grp = ? AND day = ? AND num = ?`, group, day.Format(dayKeyFormat), num)
+	return err
+}
+
+// PruneOverrides removes overrides for days before specified one.
+func (s *Storage) PruneOverrides(before time.Time) error {
+	_, err := s.db.Exec(`DELETE FROM overrides WHERE day < ?`, before.Format(dayKeyFormat))
+	return err
+}
+
+func (s *Storage) SetChatGroup(chatID int64, group string) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO chat_groups VALUES (?, ?)`, chatID, group)
+	return err
+}
+
+// LoadChatGroups returns groups bound to chats using SetChatGroup.
+func (s *Storage) LoadChatGroups() (map[int64]string, error) {
+	rows, err := s.db.Query(`SELECT chat_id, grp FROM chat_groups`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[int64]string)
+	for rows.Next() {
+		var chatID int64
+		var group string
+		if err := rows.Scan(&chatID, &group); err != nil {
+			return nil, err
+		}
+		res[chatID] = group
+	}
+	return res, rows.Err()
+}
+
+func slotToMins(slot TimeSlot) int {
+	return slot.Hour*60 + slot.Minute
+}
+
+func minsToSlot(mins int) TimeSlot {
+	return TimeSlot{mins / 60, mins % 60}
+}
+
+func (s *Storage) SaveSubscription(sub Subscription) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO subscriptions VALUES (?, ?, ?, ?, ?, ?)`,
+		sub.ChatID, sub.LeadMins, int(sub.Events),
+		slotToMins(sub.QuietFrom), slotToMins(sub.QuietTo), slotToMins(sub.SummaryAt))
+	return err
+}
+
+func (s *Storage) DeleteSubscription(chatID int64) error {
+	_, err := s.db.Exec(`DELETE FROM subscriptions WHERE chat_id = ?`, chatID)
+	return err
+}
+
+func (s *Storage) LoadSubscriptions() ([]Subscription, error) {
+	rows, err := s.db.Query(`SELECT chat_id, lead_mins, events, quiet_from, quiet_to, summary_at FROM subscriptions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []Subscription{}
+	for rows.Next() {
+		var sub Subscription
+		var events, quietFrom, quietTo, summaryAt int
+		if err := rows.Scan(&sub.ChatID, &sub.LeadMins, &events, &quietFrom, &quietTo, &summaryAt); err != nil {
+			return nil, err
+		}
+		sub.Events = NotifyEvent(events)
+		sub.QuietFrom = minsToSlot(quietFrom)
+		sub.QuietTo = minsToSlot(quietTo)
+		sub.SummaryAt = minsToSlot(summaryAt)
+		res = append(res, sub)
+	}
+	return res, rows.Err()
+}
+
+func (s *Storage) SaveDigest(d Digest) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO digests VALUES (?, ?, ?)`,
+		d.ChatID, slotToMins(d.At), d.DayOffset)
+	return err
+}
+
+// DeleteDigests deletes chat's digest sent at specified time or all of
+// chat's digests if at is nil.
+func (s *Storage) DeleteDigests(chatID int64, at *TimeSlot) error {
+	if at == nil {
+		_, err := s.db.Exec(`DELETE FROM digests WHERE chat_id = ?`, chatID)
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM digests WHERE chat_id = ? AND at = ?`, chatID, slotToMins(*at))
+	return err
+}
+
+func (s *Storage) LoadDigests() ([]Digest, error) {
+	rows, err := s.db.Query(`SELECT chat_id, at, day_offset FROM digests ORDER BY chat_id, at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []Digest{}
+	for rows.Next() {
+		var d Digest
+		var at int
+		if err := rows.Scan(&d.ChatID, &at, &d.DayOffset); err != nil {
+			return nil, err
+		}
+		d.At = minsToSlot(at)
+		res = append(res, d)
+	}
+	return res, rows.Err()
+}
+
+func (s *Storage) SavePinned(p PinnedMessage) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO pinned_messages VALUES (?, ?, ?)`,
+		p.ChatID, p.MessageID, p.Day.Format(dayKeyFormat))
+	return err
+}
+
+func (s *Storage) LoadPinned(loc *time.Location) ([]PinnedMessage, error) {
+	rows, err := s.db.Query(`SELECT chat_id, message_id, day FROM pinned_messages`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []PinnedMessage{}
+	for rows.Next() {
+		var p PinnedMessage
+		var day string
+		if err := rows.Scan(&p.ChatID, &p.MessageID, &day); err != nil {
+			return nil, err
+		}
+		p.Day, err = time.ParseInLocation(dayKeyFormat, day, loc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "pinned message in chat %d", p.ChatID)
+		}
+		res = append(res, p)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NotifyEvent is a bitmask of events user wants to be notified about.
+type NotifyEvent int
+
+const (
+	// EventStart is sent before each lesson.
+	EventStart NotifyEvent = 1
+	// EventBreak is sent on break in the middle of lesson.
+	EventBreak NotifyEvent = 2
+	// EventEnd is sent on lesson end.
+	EventEnd NotifyEvent = 4
+	// EventFirst is sent well before first lesson of day.
+	EventFirst NotifyEvent = 8
+	// EventSummary is whole day timetable sent at specified time.
+	EventSummary NotifyEvent = 16
+	// EventChanges is sent when downloaded timetable changes.
+	EventChanges NotifyEvent = 32
+	// EventExams are exam countdowns and day-before reminders, sent at
+	// summary time.
+	EventExams NotifyEvent = 64
+)
+
+var eventNames = map[string]NotifyEvent{
+	"start":   EventStart,
+	"break":   EventBreak,
+	"end":     EventEnd,
+	"first":   EventFirst,
+	"summary": EventSummary,
+	"changes": EventChanges,
+	"exams":   EventExams,
+}
+
+func parseEvents(str string) (NotifyEvent, error) {
+	res := NotifyEvent(0)
+	for _, name := range strings.Split(str, ",") {
+		event, prs := eventNames[strings.ToLower(strings.TrimSpace(name))]
+		if !prs {
+			return 0, errors.Errorf("unknown event: %s", name)
+		}
+		res |= event
+	}
+	return res, nil
+}
+
+func (e NotifyEvent) String() string {
+	names := []string{}
+	for name, event := range eventNames {
+		if e&event != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// Subscription contains notification preferences of user subscribed
+// using /subscribe. Group is the one bound to user's chat.
+type Subscription struct {
+	ChatID   int64
+	LeadMins int
+	Events   NotifyEvent
+	// No notifications are sent between QuietFrom and QuietTo.
+	// Quiet hours are disabled if they are equal.
+	QuietFrom TimeSlot
+	QuietTo   TimeSlot
+	SummaryAt TimeSlot
+}
+
+func (s Subscription) isQuiet(now time.Time) bool {
+	if s.QuietFrom == s.QuietTo {
+		return false
+	}
+	nowMins := now.Hour()*60 + now.Minute()
+	fromMins := s.QuietFrom.Hour*60 + s.QuietFrom.Minute
+	toMins := s.QuietTo.Hour*60 + s.QuietTo.Minute
+	if fromMins < toMins {
+		return nowMins >= fromMins && nowMins < toMins
+	}
+	// Quiet hours span midnight.
+	return nowMins >= fromMins || nowMins < toMins
+}
+
+func (s Subscription) prefs() notifyPrefs {
+	return notifyPrefs{s.LeadMins, s.Events, s.SummaryAt, s.SummaryAt}
+}
+
+func defaultSubscription(chatID int64) Subscription {
+	return Subscription{
+		ChatID:    chatID,
+		LeadMins:  config().NotifyInMins,
+		Events:    EventStart | EventFirst | EventChanges | EventExams,
+		SummaryAt: TimeSlot{7, 0},
+	}
+}
+
+var (
+	subscriptionsLck sync.RWMutex
+	subscriptions    = make(map[int64]Subscription)
+)
+
+func loadSubscriptions() error {
+	if storage == nil {
+		return nil
+	}
+	subs, err := storage.LoadSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	subscriptionsLck.Lock()
+	defer subscriptionsLck.Unlock()
+	for _, sub := range subs {
+		subscriptions[sub.ChatID] = sub
+	}
+	return nil
+}
+
+func getSubscription(chatID int64) (Subscription, bool) {
+	subscriptionsLck.RLock()
+	defer subscriptionsLck.RUnlock()
+	sub, prs := subscriptions[chatID]
+	return sub, prs
+}
+
+func allSubscriptions() []Subscription {
+	subscriptionsLck.RLock()
+	defer subscriptionsLck.RUnlock()
+	res := make([]Subscription, 0, len(subscriptions))
+	for _, sub := range subscriptions {
+		res = append(res, sub)
+	}
+	return res
+}
+
+// saveSubscription creates or updates subscription.
+func saveSubscription(sub Subscription) error {
+	if storage != nil {
+		if err := storage.SaveSubscription(sub); err != nil {
+			return errors.Wrap(err, "save subscription")
+		}
+	}
+
+	subscriptionsLck.Lock()
+	defer subscriptionsLck.Unlock()
+	subscriptions[sub.ChatID] = sub
+	return nil
+}
+
+func removeSubscription(chatID int64) error {
+	if storage != nil {
+		if err := storage.DeleteSubscription(chatID); err != nil {
+			return errors.Wrap(err, "delete subscription")
+		}
+	}
+
+	subscriptionsLck.Lock()
+	defer subscriptionsLck.Unlock()
+	delete(subscriptions, chatID)
+	return nil
+}
@@ -10,15 +10,44 @@ import (
 	"time"
 )
 
-var tableUrl = `http://e-rozklad.dut.edu.ua/timeTable/groupExcel?type=0`
+const defaultTableUrl = `http://e-rozklad.dut.edu.ua/timeTable/groupExcel?type=0`
+
+func init() {
+	Register("dut", newDUTSource)
+}
 
 type Cfg struct {
-	Course  int `yaml:"course"`
-	Faculty int `yaml:"faculty"`
-	Group   int `yaml:"group"`
+	URL     string `yaml:"url"`
+	Course  int    `yaml:"course"`
+	Faculty int    `yaml:"faculty"`
+	Group   int    `yaml:"group"`
+}
+
+// dutSource downloads timetable from DUT e-rozklad as XLS sheet.
+type dutSource struct {
+	cfg Cfg
+}
+
+func newDUTSource(params map[string]interface{}) (Source, error) {
+	cfg := Cfg{}
+	if err := DecodeParams(params, &cfg); err != nil {
+		return nil, errors.Wrap(err, "dut source config")
+	}
+	if cfg.URL == "" {
+		cfg.URL = defaultTableUrl
+	}
+	return dutSource{cfg}, nil
+}
+
+func (s dutSource) Fetch(from, to time.Time) (map[time.Time][]RawEntry, error) {
+	return Download(from, to, s.cfg)
 }
 
 func Download(from, to time.Time, cfg Cfg) (map[time.Time][]RawEntry, error) {
+	tableUrl := cfg.URL
+	if tableUrl == "" {
+		tableUrl = defaultTableUrl
+	}
 	form := url.Values{
 		"timeTable":              {"0"},
 		"TimeTableForm[course]":  {strconv.Itoa(cfg.Course)},
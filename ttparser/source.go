@@ -0,0 +1,74 @@
+package ttparser
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Source is anything that can provide timetable entries for a range of days.
+type Source interface {
+	// Fetch returns entries for all days in range [from, to], keyed by
+	// day (with time stripped, in UTC).
+	Fetch(from, to time.Time) (map[time.Time][]RawEntry, error)
+}
+
+// SourceFactory creates new Source using source-specific configuration
+// options (everything in source config except type). It's also used to
+// validate config, so it should not make network requests.
+type SourceFactory func(params map[string]interface{}) (Source, error)
+
+var (
+	factoriesLck sync.RWMutex
+	factories    = make(map[string]SourceFactory)
+)
+
+// Register makes source available under specified name.
+// It panics if name is already taken.
+func Register(name string, factory SourceFactory) {
+	factoriesLck.Lock()
+	defer factoriesLck.Unlock()
+
+	if _, prs := factories[name]; prs {
+		panic("ttparser: source " + name + " registered twice")
+	}
+	factories[name] = factory
+}
+
+// Sources returns names of all registered sources.
+func Sources() []string {
+	factoriesLck.RLock()
+	defer factoriesLck.RUnlock()
+
+	res := make([]string, 0, len(factories))
+	for name := range factories {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// NewSource creates source registered under specified name.
+func NewSource(name string, params map[string]interface{}) (Source, error) {
+	factoriesLck.RLock()
+	factory, prs := factories[name]
+	factoriesLck.RUnlock()
+
+	if !prs {
+		return nil, errors.Errorf("unknown source type: %s (available: %v)", name, Sources())
+	}
+	return factory(params)
+}
+
+// DecodeParams decodes params passed to SourceFactory into out, rejecting
+// unknown keys.
+func DecodeParams(params map[string]interface{}, out interface{}) error {
+	blob, err := yaml.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(blob, out)
+}
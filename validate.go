@@ -0,0 +1,270 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/timetable_bot/ttparser"
+	"github.com/pkg/errors"
+	"github.com/slongfield/pyfmt"
+)
+
+// webhookTokenRe matches secret tokens accepted by Telegram, empty token
+// is checked separately.
+var webhookTokenRe = regexp.MustCompile(`^[A-Za-z0-9_-]{0,256}$`)
+
+// ValidationError lists all problems found in configuration.
+type ValidationError []error
+
+func (e ValidationError) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Validate checks config for problems that would otherwise show up only
+// at runtime. All problems are returned, not just first one.
+func (c *Config) Validate() []error {
+	res := []error{}
+	problem := func(format string, args ...interface{}) {
+		res = append(res, errors.Errorf(format, args...))
+	}
+
+	if c.Token == "" {
+		problem("token is empty")
+	}
+	if c.Lang == "" {
+		problem("lang is empty")
+	}
+	if c.CmdProcGoroutines <= 0 {
+		problem("cmd_processing_goroutines should be positive, got %d", c.CmdProcGoroutines)
+	}
+	if c.TimeZone == "" {
+		problem("timezone is empty")
+	} else if _, err := time.LoadLocation(c.TimeZone); err != nil {
+		problem("unknown timezone %s: %v", c.TimeZone, err)
+	}
+	if c.NotifyInMins < 0 {
+		problem("notify_in_mins should not be negative, got %d", c.NotifyInMins)
+	}
+	if c.Prefetch.IntervalMins < 0 || c.Prefetch.JitterSecs < 0 || c.Prefetch.MaxBackoffMins < 0 {
+		problem("prefetch values should not be negative")
+	}
+	for _, days := range c.Exams.CountdownDays {
+		if days <= 0 {
+			problem("exams.countdown_days should be positive, got %d", days)
+		}
+	}
+	if c.Exams.NotifyChats && c.Exams.NotifyAt == nil {
+		problem("exams.notify_at is required if exams.notify_chats is set")
+	}
+	if c.Webhook.Listen != "" && c.Webhook.URL == "" {
+		problem("webhook.url is required if webhook.listen is set")
+	}
+	if c.Webhook.Listen != "" && c.Webhook.SecretToken == "" {
+		problem("webhook.secret_token is required if webhook.listen is set")
+	}
+	if !webhookTokenRe.MatchString(c.Webhook.SecretToken) {
+		problem("webhook.secret_token should be 1-256 characters A-Z, a-z, 0-9, _ and -")
+	}
+	if (c.Webhook.TLSCert == "") != (c.Webhook.TLSKey == "") {
+		problem("webhook.tls_cert and webhook.tls_key should be set together")
+	}
+	if c.Webhook.UploadCert && c.Webhook.TLSCert == "" {
+		problem("webhook.upload_cert requires webhook.tls_cert")
+	}
+
+	res = append(res, c.validateTimeslots()...)
+
+	if len(c.Groups) == 0 {
+		problem("no groups defined")
+	}
+	if _, prs := c.Groups[c.DefaultGroup]; c.DefaultGroup != "" && !prs {
+		problem("default_group is not defined: %s", c.DefaultGroup)
+	}
+	names := make([]string, 0, len(c.Groups))
+	for name := range c.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		group := c.Groups[name]
+		// Source is created same way as on start, so invalid parameters are
+		// reported too. Unknown type is reported by NewSource as well.
+		if _, err := ttparser.NewSource(group.Source.Type, group.Source.Params); err != nil {
+			problem("groups.%s.source: %v", name, err)
+		}
+		if len(group.PinChats) != 0 && group.PinAt == nil {
+			problem("groups.%s.pin_at is required if pin_chats is set", name)
+		}
+		for _, d := range group.Digests {
+			if _, prs := digestDays[d.Day]; !prs {
+				problem("groups.%s.digests: unknown day %q (should be today or tomorrow)", name, d.Day)
+			}
+		}
+	}
+	return res
+}
+
+// validateTimeslots checks that all lists of timeslots have same length,
+// each lesson has break inside it and lessons don't overlap.
+func (c *Config) validateTimeslots() []error {
+	res := []error{}
+	if len(c.TimeslotsBegin) == 0 {
+		res = append(res, errors.New("timeslots_begin is empty"))
+	}
+	if len(c.TimeslotsEnd) != len(c.TimeslotsBegin) || len(c.TimeslotsBreak) != len(c.TimeslotsBegin) {
+		res = append(res, errors.Errorf("timeslots_begin, timeslots_break and timeslots_end should have same length, got %d, %d and %d",
+			len(c.TimeslotsBegin), len(c.TimeslotsBreak), len(c.TimeslotsEnd)))
+		return res
+	}
+
+	for i := range c.TimeslotsBegin {
+		begin := slotToMins(c.TimeslotsBegin[i])
+		brk := slotToMins(c.TimeslotsBreak[i])
+		end := slotToMins(c.TimeslotsEnd[i])
+		if begin >= end {
+			res = append(res, errors.Errorf("lesson %d ends (%v) before it begins (%v)", i+1, c.TimeslotsEnd[i], c.TimeslotsBegin[i]))
+		} else if brk < begin || brk > end {
+			res = append(res, errors.Errorf("break of lesson %d (%v) is outside of it", i+1, c.TimeslotsBreak[i]))
+		}
+		if i != 0 && begin < slotToMins(c.TimeslotsEnd[i-1]) {
+			res = append(res, errors.Errorf("lesson %d (%v) begins before lesson %d ends (%v)",
+				i+1, c.TimeslotsBegin[i], i, c.TimeslotsEnd[i-1]))
+		}
+	}
+	return res
+}
+
+// Validate checks that all strings are present in lang file.
+func (l *LangStrings) Validate() []error {
+	res := []error{}
+	missingKeys(reflect.ValueOf(*l), "", &res)
+
+	for t := Lab; t <= Seminar; t++ {
+		if _, prs := l.LessonTypes[t]; !prs {
+			res = append(res, errors.Errorf("lesson_types: missing name of type %d", t))
+		}
+	}
+	for _, cmd := range commands {
+		if _, prs := l.Commands[cmd.name]; !prs {
+			res = append(res, errors.Errorf("commands: missing description of %s", cmd.name))
+		}
+		for _, arg := range cmd.args {
+			if _, prs := l.ArgNames[arg.name]; !prs {
+				res = append(res, errors.Errorf("args: missing name of %s", arg.name))
+			}
+		}
+	}
+	for _, t := range l.templates() {
+		if _, err := pyfmt.Fmt(t.tmpl, templateArgs(t.args...)); err != nil {
+			res = append(res, errors.Errorf("%s: %v", t.key, err))
+		}
+	}
+	if len(l.Weekdays) != 7 {
+		res = append(res, errors.Errorf("weekdays should contain 7 names, got %d", len(l.Weekdays)))
+	}
+	if len(l.WeekdaysShort) != 7 {
+		res = append(res, errors.Errorf("weekdays_short should contain 7 names, got %d", len(l.WeekdaysShort)))
+	}
+	return res
+}
+
+// langTemplate is lang string formatted using pyfmt with args placeholders.
+type langTemplate struct {
+	key  string
+	tmpl string
+	args []string
+}
+
+// templates lists all lang strings formatted using pyfmt. Placeholders
+// should match ones passed by code, otherwise pyfmt.Must panics at runtime.
+func (l *LangStrings) templates() []langTemplate {
+	entry := []string{"num", "classroom", "name", "startTime", "endTime", "type", "lecturer"}
+	exam := []string{"weekday", "date", "startTime", "name", "type", "classroom", "lecturer", "countdown"}
+	change := []string{"day", "num", "name", "type", "classroom"}
+	fieldChange := append([]string{"old", "new"}, change...)
+
+	res := []langTemplate{
+		{"help", l.Help, []string{"commands"}},
+		{"adminhelp", l.AdminHelp, []string{"commands"}},
+		{"command_help_format", l.CommandHelpFormat, []string{"command", "description"}},
+		{"replies.timetable_header", l.Replies.TimetableHeader, []string{"date"}},
+		{"replies.outdated", l.Replies.Outdated, []string{"time"}},
+		{"replies.cache_stats", l.Replies.CacheStats, []string{"downloads", "failed", "coalesced"}},
+		{"replies.invalid_range", l.Replies.InvalidRange, []string{"max"}},
+		{"replies.week_header", l.Replies.WeekHeader, []string{"from", "to"}},
+		{"replies.digests", l.Replies.Digests, []string{"digests"}},
+		{"replies.usage", l.Replies.Usage, []string{"command"}},
+		{"replies.reload_failed", l.Replies.ReloadFailed, []string{"error"}},
+		{"entry_template", l.EntryTemplate, entry},
+		{"exam_entry_template", l.ExamEntryTemplate, entry},
+		{"timeslot_format", l.TimeslotFormat, []string{"num", "start", "end", "break"}},
+		{"notify_settings", l.NotifySettings, []string{"lead", "events", "quiet", "summary"}},
+		{"week_day_header", l.WeekDayHeader, []string{"weekday", "date"}},
+		{"week_entry_template", l.WeekEntryTemplate, []string{"num", "startTime", "name", "type", "classroom"}},
+		{"find_result", l.FindResult, []string{"weekday", "date", "num", "startTime", "name", "type", "classroom", "lecturer"}},
+		{"changes.added", l.Changes.Added, change},
+		{"changes.removed", l.Changes.Removed, change},
+		{"changes.name", l.Changes.Name, fieldChange},
+		{"changes.type", l.Changes.Type, fieldChange},
+		{"changes.classroom", l.Changes.Classroom, fieldChange},
+		{"changes.lecturer", l.Changes.Lecturer, fieldChange},
+		{"inline.title", l.Inline.Title, []string{"weekday", "date", "group"}},
+		{"exams.item", l.Exams.Item, exam},
+		{"exams.countdown", l.Exams.Countdown, exam},
+		{"exams.reminder", l.Exams.Reminder, exam},
+		{"exams.in_days", l.Exams.InDays, []string{"days"}},
+	}
+	names := make([]string, 0, len(l.Usage))
+	for name := range l.Usage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		res = append(res, langTemplate{"usage." + name, l.Usage[name], []string{"groups", "current"}})
+	}
+	return res
+}
+
+// numericArgs are template placeholders that are passed as numbers, so
+// templates can use numeric format specs for them.
+var numericArgs = map[string]bool{
+	"num": true, "days": true, "lead": true, "max": true,
+	"downloads": true, "failed": true, "coalesced": true,
+}
+
+// templateArgs returns sample values for placeholders.
+func templateArgs(names ...string) map[string]interface{} {
+	res := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		if numericArgs[name] {
+			res[name] = 1
+		} else {
+			res[name] = "x"
+		}
+	}
+	return res
+}
+
+// missingKeys reports empty strings, maps and slices in v, recursing into
+// nested structs. Keys are named as in YAML.
+func missingKeys(v reflect.Value, prefix string, res *[]error) {
+	for i := 0; i < v.NumField(); i++ {
+		key := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.Struct:
+			missingKeys(field, prefix+key+".", res)
+		case reflect.String, reflect.Map, reflect.Slice:
+			if field.Len() == 0 {
+				*res = append(*res, errors.Errorf("missing lang key %s%s", prefix, key))
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+)
+
+// maxWebhookBody limits size of update accepted by webhook.
+const maxWebhookBody = 1 << 20
+
+type WebhookConfig struct {
+	// Listen is address of webhook listener, e.g. ":8443". Long polling is
+	// used if it's empty.
+	Listen string `yaml:"listen"`
+	// URL is public address of listener as seen by Telegram, without
+	// SecretPath.
+	URL string `yaml:"url"`
+	// SecretPath is appended to URL and to path served by listener.
+	SecretPath string `yaml:"secret_path"`
+	// SecretToken is sent by Telegram in X-Telegram-Bot-Api-Secret-Token
+	// header of each request. Requests without it are rejected. Required,
+	// otherwise anyone could send updates on behalf of admins.
+	SecretToken string `yaml:"secret_token"`
+	// TLSCert and TLSKey enable TLS on listener. Not needed if TLS is
+	// terminated by reverse proxy.
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+	// UploadCert sends TLSCert to Telegram, required for self-signed
+	// certificates.
+	UploadCert     bool `yaml:"upload_cert"`
+	MaxConnections int  `yaml:"max_connections"`
+}
+
+// webhookServer is nil if long polling is used.
+var webhookServer *http.Server
+
+func webhookPath() string {
+	return "/" + strings.Trim(config().Webhook.SecretPath, "/")
+}
+
+// setWebhook registers webhook in Telegram. tgbotapi's SetWebhook is not
+// used because it doesn't support secret_token.
+func setWebhook() error {
+	params := map[string]string{
+		"url": strings.TrimSuffix(config().Webhook.URL, "/") + webhookPath(),
+	}
+	params["secret_token"] = config().Webhook.SecretToken
+	if config().Webhook.MaxConnections != 0 {
+		params["max_connections"] = strconv.Itoa(config().Webhook.MaxConnections)
+	}
+
+	var resp tgbotapi.APIResponse
+	var err error
+	if config().Webhook.UploadCert {
+		resp, err = bot.UploadFile("setWebhook", params, "certificate", config().Webhook.TLSCert)
+	} else {
+		values := url.Values{}
+		for k, v := range params {
+			values.Set(k, v)
+		}
+		resp, err = bot.MakeRequest("setWebhook", values)
+	}
+	if err != nil {
+		return err
+	}
+	if !resp.Ok {
+		return errors.New(resp.Description)
+	}
+	return nil
+}
+
+// startWebhook registers webhook and starts listener, returned channel
+// receives updates sent by Telegram.
+func startWebhook() (tgbotapi.UpdatesChannel, error) {
+	if err := setWebhook(); err != nil {
+		return nil, errors.Wrap(err, "setWebhook")
+	}
+
+	updates := make(chan tgbotapi.Update, bot.Buffer)
+	mux := http.NewServeMux()
+	mux.HandleFunc(webhookPath(), func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Empty secret_token is rejected by Validate, but check it anyway:
+		// empty header would match it.
+		secret := config().Webhook.SecretToken
+		token := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+		if secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		var update tgbotapi.Update
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxWebhookBody)).Decode(&update); err != nil {
+			log.Println("ERROR: Failed to decode webhook update:", err)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		updates <- update
+	})
+
+	webhookServer = &http.Server{
+		Addr:         config().Webhook.Listen,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	go func() {
+		var err error
+		if config().Webhook.TLSCert != "" {
+			err = webhookServer.ListenAndServeTLS(config().Webhook.TLSCert, config().Webhook.TLSKey)
+		} else {
+			err = webhookServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalln("Webhook listener failed:", err)
+		}
+	}()
+	return updates, nil
+}
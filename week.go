@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
+	"github.com/slongfield/pyfmt"
+)
+
+// weekCallbackPrefix marks callback data that switches message to week view,
+// data without prefix switches it to day view.
+const weekCallbackPrefix = "w:"
+
+func weekdayShortName(t time.Time) string {
+	if len(lang().WeekdaysShort) != 7 {
+		return t.Weekday().String()[:2]
+	}
+	return lang().WeekdaysShort[t.Weekday()]
+}
+
+// formatWeek formats entries of week starting at from in compact form.
+// Days without lessons are omitted.
+func formatWeek(from time.Time, week [][]Entry, retrievedOn time.Time) string {
+	_, to := weekBounds(from)
+	res := pyfmt.Must(lang().Replies.WeekHeader, map[string]interface{}{
+		"from": from.Format("02.01"),
+		"to":   to.Format("02.01.2006"),
+	})
+
+	days := []string{}
+	for i, entries := range week {
+		if len(entries) == 0 {
+			continue
+		}
+		day := from.AddDate(0, 0, i)
+		lines := []string{pyfmt.Must(lang().WeekDayHeader, map[string]interface{}{
+			"weekday": weekdayName(day),
+			"date":    day.Format("02.01"),
+		})}
+		for _, ent := range entries {
+			lines = append(lines, pyfmt.Must(lang().WeekEntryTemplate, map[string]interface{}{
+				"num":       ttindex(TimeSlot{ent.Time.Hour(), ent.Time.Minute()}),
+				"startTime": ent.Time.Format("15:04"),
+				"name":      ent.Name,
+				"type":      lang().LessonTypes[ent.Type],
+				"classroom": ent.Classroom,
+			}))
+		}
+		days = append(days, strings.Join(lines, "\n"))
+	}
+	if len(days) == 0 {
+		days = append(days, lang().Replies.Empty)
+	}
+	return res + strings.Join(days, "\n\n") + outdatedNote(retrievedOn)
+}
+
+// weekEntries returns entries for each day of week starting at from and
+// time when the oldest of them was downloaded.
+func weekEntries(group string, from time.Time) ([][]Entry, time.Time, error) {
+	week := make([][]Entry, 7)
+	oldest := time.Time{}
+	for i := range week {
+		entries, retrievedOn, err := cache.OnDayWithAge(group, from.AddDate(0, 0, i))
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		week[i] = entries
+		if oldest.IsZero() || retrievedOn.Before(oldest) {
+			oldest = retrievedOn
+		}
+	}
+	return week, oldest, nil
+}
+
+func makeWeekButtons(from time.Time) tgbotapi.InlineKeyboardMarkup {
+	days := make([]tgbotapi.InlineKeyboardButton, 7)
+	for i := range days {
+		day := from.AddDate(0, 0, i)
+		days[i] = tgbotapi.NewInlineKeyboardButtonData(weekdayShortName(day), day.Format("02.01.06"))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(
+		[]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("\u23EA",
+				weekCallbackPrefix+from.AddDate(0, 0, -7).Format("02.01.06")),
+			tgbotapi.NewInlineKeyboardButtonData("\u23E9",
+				weekCallbackPrefix+from.AddDate(0, 0, 7).Format("02.01.06")),
+		},
+		days,
+	)
+}
+
+func weekCmd(msg *tgbotapi.Message, args cmdArgs) error {
+	day := StripTime(time.Now().In(timezone), timezone)
+	if args.has("date") {
+		day = args.date("date")
+	}
+
+	group, ok, err := msgGroup(msg)
+	if !ok {
+		return err
+	}
+
+	from, _ := weekBounds(day)
+	week, retrievedOn, err := weekEntries(group, from)
+	if err != nil {
+		reportError(err, msg)
+		return err
+	}
+
+	_, err = replyTo(msg, formatWeek(from, week, retrievedOn), makeWeekButtons(from))
+	if err != nil {
+		return errors.Wrapf(err, "replyTo chatid=%d, msgid=%d", msg.Chat.ID, msg.MessageID)
+	}
+	return nil
+}